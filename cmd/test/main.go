@@ -98,8 +98,23 @@ func runBenchmark(concurrency, totalRequests int, mode string, test_port int) be
 func main() {
 	mode := flag.String("mode", "http", "http, socks5, socks5-connect")
 	test_port := flag.Int("test_port", 8081, "test port")
+	relay := flag.Int("relay", 0, "benchmark the relay with this many MiB instead of the proxy")
 	flag.Parse()
 
+	if *relay > 0 {
+		for _, splice := range []bool{true, false} {
+			fmt.Printf("Running relay benchmark: %d MiB, splice %v\n", *relay, splice)
+			result, err := runRelayBenchmark(*relay, splice)
+			if err != nil {
+				fmt.Printf("Error: %v\n\n", err)
+				continue
+			}
+			fmt.Printf("Throughput: %.2f MiB/s\n", result.throughput)
+			fmt.Printf("CPU time:   %v\n\n", result.cpu)
+		}
+		return
+	}
+
 	concurrencyLevels := [][]int{
 		{100, 600},
 		{250, 1500},
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/nio"
+)
+
+type relayResult struct {
+	throughput float64
+	cpu        time.Duration
+}
+
+// opaqueConn hides the TCP connection from the relay, so that data is copied instead of spliced
+type opaqueConn struct {
+	net.Conn
+}
+
+func (c opaqueConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, <-accepted, nil
+}
+
+// cpuTime returns the CPU time used by the process
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// runRelayBenchmark relays size MiB from a client to a target through the relay of the proxy,
+// with splice(2) or by copying, and measures the throughput and the CPU time used
+func runRelayBenchmark(size int, splice bool) (relayResult, error) {
+	client, clientPeer, err := tcpPair()
+	if err != nil {
+		return relayResult{}, err
+	}
+	target, targetPeer, err := tcpPair()
+	if err != nil {
+		return relayResult{}, err
+	}
+	defer client.Close()
+	defer targetPeer.Close()
+
+	var relayed net.Conn = target
+	if !splice {
+		relayed = opaqueConn{target}
+	}
+
+	go func() {
+		nio.CopyOnce(clientPeer, relayed, nil, nio.Timeouts{})
+		clientPeer.Close()
+		target.Close()
+	}()
+
+	startCPU := cpuTime()
+	startTime := time.Now()
+
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for written := 0; written < size*1024*1024; written += len(chunk) {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+		client.(*net.TCPConn).CloseWrite()
+	}()
+
+	n, err := io.Copy(io.Discard, targetPeer)
+	if err != nil {
+		return relayResult{}, err
+	}
+
+	elapsed := time.Since(startTime)
+	return relayResult{
+		throughput: float64(n) / 1024 / 1024 / elapsed.Seconds(),
+		cpu:        cpuTime() - startCPU,
+	}, nil
+}
@@ -4,9 +4,13 @@ go 1.23.5
 
 require (
 	github.com/libp2p/go-reuseport v0.4.0
+	github.com/miekg/dns v1.1.62
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/phuslu/lru v1.0.18
 	github.com/rs/zerolog v1.34.0
 	github.com/vishvananda/netlink v1.3.0
+	golang.org/x/sync v0.13.0
+	golang.org/x/time v0.11.0
 )
 
 require (
@@ -19,9 +23,9 @@ require (
 	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/exp/typeparams v0.0.0-20220613132600-b0d781184e0d // indirect
 	golang.org/x/lint v0.0.0-20210508222113-6edffad5e616 // indirect
-	golang.org/x/mod v0.8.0 // indirect
-	golang.org/x/sync v0.13.0 // indirect
-	golang.org/x/tools v0.6.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.27.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 	honnef.co/go/tools v0.3.2 // indirect
 )
 
@@ -31,5 +35,5 @@ require (
 	github.com/redis/go-redis/v9 v9.8.0
 	github.com/valyala/fastrand v1.1.0
 	github.com/vishvananda/netns v0.0.4 // indirect
-	golang.org/x/sys v0.32.0 // indirect
+	golang.org/x/sys v0.32.0
 )
@@ -0,0 +1,306 @@
+package accounting
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+var ErrQuotaExceeded = errors.New("data quota exceeded")
+
+// mib is the unit of the configured quotas.
+const mib = 1024 * 1024
+
+// Dimensions are what the traffic is accounted by.
+type Dimensions struct {
+	User    string `json:"user"`
+	Session string `json:"session,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// Record is the traffic of the dimensions during a flush interval.
+type Record struct {
+	Dimensions
+	Time     time.Time `json:"time"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+// counter is the traffic of the dimensions since the last flush.
+type counter struct {
+	refs     int
+	upload   atomic.Int64
+	download atomic.Int64
+}
+
+// usage is the traffic of a user, checked against their quota.
+type usage struct {
+	// flushed is the traffic known to the sink at the last flush
+	flushed atomic.Int64
+	// pending is the traffic since the last flush
+	pending atomic.Int64
+	meters  map[*Meter]struct{}
+}
+
+func (u *usage) total() int64 {
+	return u.flushed.Load() + u.pending.Load()
+}
+
+// Accountant counts the traffic of the users and flushes it to a sink.
+type Accountant struct {
+	sink Sink
+
+	mu       sync.Mutex
+	counters map[Dimensions]*counter
+	users    map[string]*usage
+}
+
+// New returns an accountant flushing to the sink, nil to only count in memory
+func New(sink Sink) *Accountant {
+	return &Accountant{
+		sink:     sink,
+		counters: make(map[Dimensions]*counter),
+		users:    make(map[string]*usage),
+	}
+}
+
+// Meter counts the traffic of a connection.
+type Meter struct {
+	accountant *Accountant
+	dims       Dimensions
+	quota      int64
+	counter    *counter
+	usage      *usage
+	closer     func()
+	closed     atomic.Bool
+}
+
+// Open starts counting the traffic of a connection. The closer is called when the
+// quota of the user is exceeded, to stop the connection. The meter must be closed
+// when the connection is.
+func (a *Accountant) Open(dims Dimensions, limits config.Limits, closer func()) (*Meter, error) {
+	u := a.getUsage(dims.User)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	quota := int64(limits.Quota) * mib
+	if quota > 0 && u.total() >= quota {
+		return nil, ErrQuotaExceeded
+	}
+
+	c, ok := a.counters[dims]
+	if !ok {
+		c = &counter{}
+		a.counters[dims] = c
+	}
+	c.refs++
+
+	m := &Meter{accountant: a, dims: dims, quota: quota, counter: c, usage: u, closer: closer}
+	u.meters[m] = struct{}{}
+
+	return m, nil
+}
+
+// Check returns ErrQuotaExceeded when the user has used up their quota, for requests to be
+// denied before connecting to the target
+func (a *Accountant) Check(user string, limits config.Limits) error {
+	quota := int64(limits.Quota) * mib
+	if quota > 0 && a.getUsage(user).total() >= quota {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// getUsage returns the usage of the user, read from the sink if not known yet
+func (a *Accountant) getUsage(user string) *usage {
+	a.mu.Lock()
+	u, ok := a.users[user]
+	a.mu.Unlock()
+	if ok {
+		return u
+	}
+
+	var used int64
+	if source, ok := a.sink.(UsageSource); ok {
+		var err error
+		if used, err = source.Usage(user); err != nil {
+			log.Error().Err(err).Str("user", user).Msg("Failed to read usage")
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Another connection may have read it meanwhile
+	if u, ok := a.users[user]; ok {
+		return u
+	}
+
+	u = &usage{meters: make(map[*Meter]struct{})}
+	u.flushed.Store(used)
+	a.users[user] = u
+
+	return u
+}
+
+// Close stops counting the traffic of the connection
+func (m *Meter) Close() {
+	if m == nil || m.closed.Swap(true) {
+		return
+	}
+
+	a := m.accountant
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m.counter.refs--
+	delete(m.usage.meters, m)
+}
+
+// Upload counts a chunk sent by the user
+func (m *Meter) Upload(n int) {
+	if m != nil {
+		m.add(&m.counter.upload, int64(n))
+	}
+}
+
+// Download counts a chunk sent to the user
+func (m *Meter) Download(n int) {
+	if m != nil {
+		m.add(&m.counter.download, int64(n))
+	}
+}
+
+// add counts the bytes, closing the connections of the user when their quota is exceeded
+func (m *Meter) add(count *atomic.Int64, n int64) {
+	count.Add(n)
+	total := m.usage.pending.Add(n) + m.usage.flushed.Load()
+
+	if m.quota > 0 && total >= m.quota {
+		m.accountant.closeAll(m.dims.User, m.usage)
+	}
+}
+
+// closeAll closes the connections of the user
+func (a *Accountant) closeAll(user string, u *usage) {
+	a.mu.Lock()
+	meters := make([]*Meter, 0, len(u.meters))
+	for m := range u.meters {
+		meters = append(meters, m)
+	}
+	a.mu.Unlock()
+
+	if len(meters) > 0 {
+		log.Warn().Str("user", user).Int("connections", len(meters)).Msg("Data quota exceeded, closing connections")
+	}
+
+	for _, m := range meters {
+		m.closer()
+		m.Close()
+	}
+}
+
+// Flush sends the traffic counted since the last flush to the sink, and refreshes the
+// usage of the users from it
+func (a *Accountant) Flush() {
+	now := time.Now()
+
+	a.mu.Lock()
+	records := make([]Record, 0, len(a.counters))
+	for dims, c := range a.counters {
+		record := Record{Dimensions: dims, Time: now, Upload: c.upload.Swap(0), Download: c.download.Swap(0)}
+		if record.Upload != 0 || record.Download != 0 {
+			records = append(records, record)
+		} else if c.refs == 0 {
+			delete(a.counters, dims)
+		}
+	}
+
+	// Idle users are forgotten if their usage can be read again from the sink
+	source, hasSource := a.sink.(UsageSource)
+	users := make(map[string]*usage, len(a.users))
+	pending := make(map[*usage]int64, len(a.users))
+	for user, u := range a.users {
+		n := u.pending.Swap(0)
+		u.flushed.Add(n)
+		if hasSource && n == 0 && len(u.meters) == 0 {
+			delete(a.users, user)
+			continue
+		}
+
+		users[user] = u
+		pending[u] = n
+	}
+	a.mu.Unlock()
+
+	if a.sink == nil || len(records) == 0 {
+		return
+	}
+
+	if err := a.sink.Flush(records); err != nil {
+		log.Error().Err(err).Int("records", len(records)).Msg("Failed to flush traffic, retrying on the next flush")
+		a.restore(records, pending)
+		return
+	}
+
+	if !hasSource {
+		return
+	}
+
+	// The sink knows the traffic of the other nodes
+	for user, u := range users {
+		used, err := source.Usage(user)
+		if err != nil {
+			log.Error().Err(err).Str("user", user).Msg("Failed to read usage")
+			continue
+		}
+		u.flushed.Store(used)
+	}
+}
+
+// restore counts again the traffic of records the sink failed to store, so that it is
+// sent on the next flush
+func (a *Accountant) restore(records []Record, pending map[*usage]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, record := range records {
+		c, ok := a.counters[record.Dimensions]
+		if !ok {
+			c = &counter{}
+			a.counters[record.Dimensions] = c
+		}
+		c.upload.Add(record.Upload)
+		c.download.Add(record.Download)
+	}
+
+	for u, n := range pending {
+		u.flushed.Add(-n)
+		u.pending.Add(n)
+	}
+}
+
+// Run flushes the counters every interval, forever
+func (a *Accountant) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.Flush()
+	}
+}
+
+// Usage returns the traffic of the user in bytes, as known by this node
+func (a *Accountant) Usage(user string) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if u, ok := a.users[user]; ok {
+		return u.total()
+	}
+
+	return 0
+}
@@ -0,0 +1,196 @@
+package accounting
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+// memorySink records the flushed records and tells the usage of the users from them
+type memorySink struct {
+	records []Record
+	err     error
+}
+
+func (s *memorySink) Flush(records []Record) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *memorySink) Usage(user string) (int64, error) {
+	var total int64
+	for _, record := range s.records {
+		if record.User == user {
+			total += record.Upload + record.Download
+		}
+	}
+
+	return total, nil
+}
+
+func TestAccountantFlush(t *testing.T) {
+	sink := &memorySink{}
+	a := New(sink)
+
+	dims := Dimensions{User: "john", Session: "abc", Country: "ch"}
+	meter, err := a.Open(dims, config.Limits{}, func() {})
+	if err != nil {
+		t.Fatalf("Open() returned error: %v", err)
+	}
+
+	meter.Upload(100)
+	meter.Download(1000)
+	meter.Upload(20)
+
+	if usage := a.Usage("john"); usage != 1120 {
+		t.Errorf("Usage() = %d, expected 1120", usage)
+	}
+
+	a.Flush()
+	if len(sink.records) != 1 {
+		t.Fatalf("Flush() sent %d records, expected 1", len(sink.records))
+	}
+	if record := sink.records[0]; record.Dimensions != dims || record.Upload != 120 || record.Download != 1000 {
+		t.Errorf("Flush() sent %+v, expected 120 bytes uploaded and 1000 downloaded", record)
+	}
+
+	// Nothing new to flush, then the idle counters and users are forgotten
+	meter.Close()
+	a.Flush()
+	if len(sink.records) != 1 || len(a.counters) != 0 || len(a.users) != 0 {
+		t.Errorf("Flush() kept %d counters and %d users", len(a.counters), len(a.users))
+	}
+
+	// The usage is read again from the sink
+	if _, err := a.Open(dims, config.Limits{}, func() {}); err != nil {
+		t.Fatalf("Open() returned error: %v", err)
+	}
+	if usage := a.Usage("john"); usage != 1120 {
+		t.Errorf("Usage() = %d after reading the sink, expected 1120", usage)
+	}
+}
+
+func TestAccountantFlushFailure(t *testing.T) {
+	sink := &memorySink{err: errors.New("unavailable")}
+	a := New(sink)
+
+	dims := Dimensions{User: "john"}
+	meter, err := a.Open(dims, config.Limits{}, func() {})
+	if err != nil {
+		t.Fatalf("Open() returned error: %v", err)
+	}
+
+	meter.Upload(100)
+	a.Flush()
+	meter.Download(50)
+	meter.Close()
+	a.Flush()
+
+	if usage := a.Usage("john"); usage != 150 {
+		t.Errorf("Usage() = %d after failed flushes, expected 150", usage)
+	}
+
+	// The traffic is sent once the sink is back
+	sink.err = nil
+	a.Flush()
+	if len(sink.records) != 1 {
+		t.Fatalf("Flush() sent %d records, expected 1", len(sink.records))
+	}
+	if record := sink.records[0]; record.Upload != 100 || record.Download != 50 {
+		t.Errorf("Flush() sent %+v, expected 100 bytes uploaded and 50 downloaded", record)
+	}
+}
+
+func TestAccountantQuota(t *testing.T) {
+	a := New(nil)
+	limits := config.Limits{Quota: 1}
+
+	closed := 0
+	first, _ := a.Open(Dimensions{User: "john"}, limits, func() { closed++ })
+	if _, err := a.Open(Dimensions{User: "john", Session: "abc"}, limits, func() { closed++ }); err != nil {
+		t.Fatalf("Open() returned error: %v", err)
+	}
+
+	first.Download(mib / 2)
+	if closed != 0 {
+		t.Errorf("Download() closed %d connections under the quota", closed)
+	}
+
+	first.Download(mib / 2)
+	if closed != 2 {
+		t.Errorf("exceeding the quota closed %d connections, expected 2", closed)
+	}
+
+	if _, err := a.Open(Dimensions{User: "john"}, limits, func() {}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Open() returned %v, expected ErrQuotaExceeded", err)
+	}
+	if _, err := a.Open(Dimensions{User: "jane"}, limits, func() {}); err != nil {
+		t.Errorf("Open() returned %v for another user", err)
+	}
+	if err := a.Check("john", limits); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Check() returned %v, expected ErrQuotaExceeded", err)
+	}
+	if err := a.Check("jane", limits); err != nil {
+		t.Errorf("Check() returned %v for another user", err)
+	}
+
+	// Without a sink to read it from, the usage survives flushes
+	a.Flush()
+	if _, err := a.Open(Dimensions{User: "john"}, limits, func() {}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Open() returned %v after a flush, expected ErrQuotaExceeded", err)
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	sink, err := NewJSONLSink(path)
+	if err != nil {
+		t.Fatalf("NewJSONLSink() returned error: %v", err)
+	}
+
+	records := []Record{
+		{Dimensions: Dimensions{User: "john", Country: "ch"}, Upload: 1, Download: 2},
+		{Dimensions: Dimensions{User: "jane"}, Upload: 3, Download: 4},
+	}
+	if err := sink.Flush(records); err != nil {
+		t.Fatalf("Flush() returned error: %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("os.Open() returned error: %v", err)
+	}
+	defer file.Close()
+
+	var lines []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("json.Unmarshal() returned error: %v", err)
+		}
+		lines = append(lines, record)
+	}
+
+	if len(lines) != 2 || lines[0].Country != "ch" || lines[1].Download != 4 {
+		t.Errorf("Flush() wrote %+v, expected %+v", lines, records)
+	}
+
+	// The usage is read back from the file, e.g. after a restart
+	reopened, err := NewJSONLSink(path)
+	if err != nil {
+		t.Fatalf("NewJSONLSink() returned error: %v", err)
+	}
+	if usage, _ := reopened.Usage("jane"); usage != 7 {
+		t.Errorf("Usage(jane) = %d after reopening the file, expected 7", usage)
+	}
+}
@@ -0,0 +1,63 @@
+package accounting
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/auth"
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+const (
+	// DefaultPrefix is the default prefix of the hash keys of the Redis sink.
+	DefaultPrefix = "usage:"
+	// DefaultInterval is the default flush interval.
+	DefaultInterval = 10 * time.Second
+)
+
+// accountant counts the traffic of the proxy, in memory until started.
+var accountant = New(nil)
+
+// Start flushes the traffic to the configured sink periodically
+func Start() error {
+	cfg := config.Get().Accounting
+
+	var sink Sink
+	switch cfg.Sink {
+	case SinkRedis:
+		prefix := cfg.Prefix
+		if prefix == "" {
+			prefix = DefaultPrefix
+		}
+		sink = NewRedisSink(auth.GetRedisClient(), prefix)
+	case SinkJSONL:
+		jsonl, err := NewJSONLSink(cfg.Path)
+		if err != nil {
+			return fmt.Errorf("opening accounting file: %w", err)
+		}
+		sink = jsonl
+	case "":
+	default:
+		return fmt.Errorf("unknown accounting sink: %s", cfg.Sink)
+	}
+
+	interval := DefaultInterval
+	if cfg.Interval > 0 {
+		interval = time.Duration(cfg.Interval) * time.Second
+	}
+
+	accountant = New(sink)
+	go accountant.Run(interval)
+
+	return nil
+}
+
+// Check returns whether the user has used up their quota, see Accountant.Check
+func Check(user string, limits config.Limits) error {
+	return accountant.Check(user, limits)
+}
+
+// Open starts counting the traffic of a connection, see Accountant.Open
+func Open(dims Dimensions, limits config.Limits, closer func()) (*Meter, error) {
+	return accountant.Open(dims, limits, closer)
+}
@@ -0,0 +1,170 @@
+package accounting
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SinkRedis string = "redis"
+	SinkJSONL string = "jsonl"
+)
+
+// Sink stores the traffic records.
+type Sink interface {
+	Flush(records []Record) error
+}
+
+// UsageSource is a sink which can tell the traffic of a user in bytes,
+// including the one of the other nodes.
+type UsageSource interface {
+	Usage(user string) (int64, error)
+}
+
+// RedisSink increments the fields of the hash of each user, prefix + user:
+// upload and download, then session:<session>:upload and country:<country>:upload
+// and their download counterparts.
+type RedisSink struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisSink returns a sink incrementing the hashes of the users
+func NewRedisSink(client *redis.Client, prefix string) *RedisSink {
+	return &RedisSink{client: client, prefix: prefix}
+}
+
+func (s *RedisSink) Flush(records []Record) error {
+	ctx := context.Background()
+	pipe := s.client.Pipeline()
+
+	for _, record := range records {
+		key := s.prefix + record.User
+		increment := func(field string) {
+			pipe.HIncrBy(ctx, key, field+"upload", record.Upload)
+			pipe.HIncrBy(ctx, key, field+"download", record.Download)
+		}
+
+		increment("")
+		if record.Session != "" {
+			increment("session:" + record.Session + ":")
+		}
+		if record.Country != "" {
+			increment("country:" + record.Country + ":")
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisSink) Usage(user string) (int64, error) {
+	values, err := s.client.HMGet(context.Background(), s.prefix+user, "upload", "download").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			n, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+	}
+
+	return total, nil
+}
+
+// JSONLSink appends the records to a file, one JSON object per line. The usage of the users
+// is read back from the file when it is opened, so that it survives restarts.
+type JSONLSink struct {
+	mu    sync.Mutex
+	file  *os.File
+	usage map[string]int64
+}
+
+// NewJSONLSink returns a sink appending to the file at the path
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	usage, err := readUsage(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONLSink{file: file, usage: usage}, nil
+}
+
+// readUsage returns the traffic of each user recorded in the file, if it exists.
+// Lines which can't be decoded, e.g. cut by a crash, are skipped.
+func readUsage(path string) (map[string]int64, error) {
+	usage := make(map[string]int64)
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("Skipping invalid accounting record")
+			continue
+		}
+		usage[record.User] += record.Upload + record.Download
+	}
+
+	return usage, scanner.Err()
+}
+
+// Flush appends the records with a single write, so that a failed flush appends none of them
+// and can be retried without counting them twice
+func (s *JSONLSink) Flush(records []Record) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		s.usage[record.User] += record.Upload + record.Download
+	}
+
+	return nil
+}
+
+func (s *JSONLSink) Usage(user string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage[user], nil
+}
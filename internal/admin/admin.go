@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/config"
+	"github.com/vlourme/go-proxy/internal/nio"
+)
+
+// Handler returns the handler of the admin endpoints
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", handleStats)
+	mux.HandleFunc("GET /bans", handleBans)
+	return mux
+}
+
+// handleStats writes the counters of the proxy
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"dns":      config.GetResolver().Stats(),
+		"prefixes": config.GetHealth().Stats(),
+	})
+}
+
+// handleBans writes the egress addresses banned by the targets
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, nio.GetBans().List())
+}
+
+// writeJSON writes the value as a JSON response
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error().Err(err).Msg("Failed to write admin response")
+	}
+}
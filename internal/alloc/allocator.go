@@ -0,0 +1,195 @@
+package alloc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/lru"
+	"github.com/vlourme/go-proxy/internal/utils"
+)
+
+var ErrExhausted = errors.New("no address available in pool")
+
+// maxAttempts is the number of candidates drawn from the strategy
+// before the pool is considered exhausted.
+const maxAttempts = 64
+
+// Options configures an Allocator.
+type Options struct {
+	// Strategy is the name of the strategy picking candidates.
+	Strategy string
+	// Exclusive guarantees that an address is never leased twice at the same time.
+	Exclusive bool
+	// Cooldown is the period during which a recently used address is not handed out again.
+	Cooldown time.Duration
+}
+
+// Allocator hands out addresses from prefixes using a strategy.
+//
+// Exclusivity and cool-down are tracked per slot: the subnet at the given
+// granularity, or the address itself when no granularity is set.
+type Allocator struct {
+	strategy  Strategy
+	exclusive bool
+	cooldown  time.Duration
+
+	mu      sync.Mutex
+	leases  map[string]time.Time
+	sweepAt int
+	recent  *lru.TTLCache[string, struct{}]
+}
+
+// Lease is an address handed out by an Allocator.
+type Lease struct {
+	IP        net.IP
+	key       string
+	allocator *Allocator
+}
+
+// New returns an allocator for the given options.
+func New(opts Options) (*Allocator, error) {
+	strategy, err := NewStrategy(opts.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Allocator{
+		strategy:  strategy,
+		exclusive: opts.Exclusive,
+		cooldown:  opts.Cooldown,
+		leases:    make(map[string]time.Time),
+		sweepAt:   1024,
+	}
+	if a.cooldown > 0 {
+		a.recent = lru.NewTTLCache[string, struct{}](1024 * 1024)
+	}
+
+	return a, nil
+}
+
+// Acquire leases an address from the prefix.
+//
+//   - If hold is zero, the lease lasts until it is released.
+//   - Otherwise, the lease expires on its own after hold.
+func (a *Allocator) Acquire(prefix net.IPNet, granularity int, hold time.Duration) (*Lease, error) {
+	return a.AcquireAvoiding(prefix, granularity, hold, nil)
+}
+
+// AcquireAvoiding leases an address from the prefix as Acquire does, skipping the
+// candidates the avoid function returns true for. Nil avoids nothing.
+func (a *Allocator) AcquireAvoiding(prefix net.IPNet, granularity int, hold time.Duration, avoid func(net.IP) bool) (*Lease, error) {
+	ones, _ := prefix.Mask.Size()
+	subnet := max(ones, granularity)
+
+	if !a.exclusive && a.cooldown == 0 {
+		for range maxAttempts {
+			ip, err := a.strategy.Next(prefix, granularity)
+			if err != nil {
+				return nil, err
+			}
+			if !utils.IsReserved(ip, subnet) && (avoid == nil || !avoid(ip)) {
+				return &Lease{IP: ip}, nil
+			}
+		}
+		return nil, ErrExhausted
+	}
+
+	slot := slotLength(prefix, granularity)
+
+	for range maxAttempts {
+		ip, err := a.strategy.Next(prefix, granularity)
+		if err != nil {
+			return nil, err
+		}
+
+		if utils.IsReserved(ip, subnet) || (avoid != nil && avoid(ip)) {
+			continue
+		}
+
+		key := ip.Mask(net.CIDRMask(slot, len(ip)*8)).String()
+		if !a.claim(key, hold) {
+			continue
+		}
+
+		return &Lease{IP: ip, key: key, allocator: a}, nil
+	}
+
+	return nil, ErrExhausted
+}
+
+// claim leases the slot and starts its cool-down, unless it is cooling down or already
+// leased. Both are checked and set at once, so that concurrent callers never claim the same slot.
+func (a *Allocator) claim(key string, hold time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cooldown > 0 {
+		if _, ok := a.recent.Get(key); ok {
+			return false
+		}
+	}
+
+	if a.exclusive && !a.lease(key, hold) {
+		return false
+	}
+
+	if a.cooldown > 0 {
+		a.recent.Set(key, struct{}{}, a.cooldown)
+	}
+
+	return true
+}
+
+// lease marks the slot as leased, unless it is already leased. The caller holds a.mu.
+// Leases without expiration are stored with a zero time.
+func (a *Allocator) lease(key string, hold time.Duration) bool {
+	now := time.Now()
+
+	if until, ok := a.leases[key]; ok && (until.IsZero() || now.Before(until)) {
+		return false
+	}
+
+	var until time.Time
+	if hold > 0 {
+		until = now.Add(hold)
+	}
+	a.leases[key] = until
+
+	// Expired leases are only removed from time to time
+	if len(a.leases) >= a.sweepAt {
+		for k, until := range a.leases {
+			if !until.IsZero() && !now.Before(until) {
+				delete(a.leases, k)
+			}
+		}
+		a.sweepAt = max(1024, 2*len(a.leases))
+	}
+
+	return true
+}
+
+// Release returns the address to its pool, the cool-down period starts over
+// from the release. Leases acquired with a hold expire on their own and
+// only restart their cool-down.
+func (l *Lease) Release() {
+	if l == nil || l.allocator == nil {
+		return
+	}
+
+	a := l.allocator
+	l.allocator = nil
+
+	if a.exclusive {
+		a.mu.Lock()
+		if until, ok := a.leases[l.key]; ok && until.IsZero() {
+			delete(a.leases, l.key)
+		}
+		a.mu.Unlock()
+	}
+
+	if a.cooldown > 0 {
+		a.recent.Set(l.key, struct{}{}, a.cooldown)
+	}
+}
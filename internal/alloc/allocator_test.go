@@ -0,0 +1,200 @@
+package alloc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSequential(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8::/44")
+
+	allocator, err := New(Options{Strategy: StrategySequential})
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+
+	for i := range 32 {
+		lease, err := allocator.Acquire(*prefix, 48, 0)
+		if err != nil {
+			t.Fatalf("Acquire() returned error: %v", err)
+		}
+
+		expected := net.ParseIP("2001:db8::").To16()
+		expected[5] = byte(i % 16)
+		if subnet := lease.IP.Mask(net.CIDRMask(48, 128)); !subnet.Equal(expected) {
+			t.Fatalf("Acquire() #%d returned %v, expected a host in %v/48", i, lease.IP, expected)
+		}
+	}
+}
+
+func TestSequentialReserved(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/30")
+
+	allocator, err := New(Options{Strategy: StrategySequential})
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+
+	// The network and broadcast addresses are skipped
+	for i := range 8 {
+		lease, err := allocator.Acquire(*prefix, 0, 0)
+		if err != nil {
+			t.Fatalf("Acquire() returned error: %v", err)
+		}
+
+		if ip := lease.IP.String(); ip != "10.0.0.1" && ip != "10.0.0.2" {
+			t.Fatalf("Acquire() #%d returned %v, expected 10.0.0.1 or 10.0.0.2", i, ip)
+		}
+	}
+}
+
+func TestLRU(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/29")
+
+	allocator, err := New(Options{Strategy: StrategyLRU})
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+
+	// Every address is handed out once before any is reused
+	seen := make(map[string]struct{})
+	for range 6 {
+		lease, err := allocator.Acquire(*prefix, 0, 0)
+		if err != nil {
+			t.Fatalf("Acquire() returned error: %v", err)
+		}
+
+		if _, ok := seen[lease.IP.String()]; ok {
+			t.Fatalf("Acquire() reused %v before exhausting the pool", lease.IP)
+		}
+		seen[lease.IP.String()] = struct{}{}
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/30")
+
+	allocator, err := New(Options{Strategy: StrategySequential, Exclusive: true})
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+
+	first, err := allocator.Acquire(*prefix, 0, 0)
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %v", err)
+	}
+
+	second, err := allocator.Acquire(*prefix, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %v", err)
+	}
+
+	if first.IP.Equal(second.IP) {
+		t.Fatalf("Acquire() returned %v twice", first.IP)
+	}
+
+	if _, err := allocator.Acquire(*prefix, 0, 0); err != ErrExhausted {
+		t.Fatalf("Acquire() returned %v, expected ErrExhausted", err)
+	}
+
+	first.Release()
+	lease, err := allocator.Acquire(*prefix, 0, 0)
+	if err != nil {
+		t.Fatalf("Acquire() returned error after release: %v", err)
+	}
+
+	if !lease.IP.Equal(first.IP) {
+		t.Fatalf("Acquire() returned %v, expected released %v", lease.IP, first.IP)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/30")
+
+	allocator, err := New(Options{Strategy: StrategyRandom, Cooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+
+	first, err := allocator.Acquire(*prefix, 0, 0)
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %v", err)
+	}
+	first.Release()
+
+	second, err := allocator.Acquire(*prefix, 0, 0)
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %v", err)
+	}
+
+	if first.IP.Equal(second.IP) {
+		t.Fatalf("Acquire() returned %v during its cool-down", first.IP)
+	}
+
+	if _, err := allocator.Acquire(*prefix, 0, 0); err != ErrExhausted {
+		t.Fatalf("Acquire() returned %v, expected ErrExhausted", err)
+	}
+}
+
+func TestCooldownConcurrent(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/30")
+
+	allocator, err := New(Options{Strategy: StrategySequential, Cooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		leased = make(map[string]int)
+	)
+	for range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if lease, err := allocator.Acquire(*prefix, 0, 0); err == nil {
+				mu.Lock()
+				leased[lease.IP.String()]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for ip, count := range leased {
+		if count > 1 {
+			t.Errorf("Acquire() returned %s %d times during its cool-down", ip, count)
+		}
+	}
+}
+
+func TestAcquireAvoiding(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8::/46")
+	_, banned, _ := net.ParseCIDR("2001:db8:1::/48")
+	avoid := func(ip net.IP) bool { return banned.Contains(ip) }
+
+	for _, opts := range []Options{{Strategy: StrategySequential}, {Strategy: StrategySequential, Exclusive: true}} {
+		allocator, err := New(opts)
+		if err != nil {
+			t.Fatalf("New() returned error: %v", err)
+		}
+
+		for range 8 {
+			lease, err := allocator.AcquireAvoiding(*prefix, 48, 0, avoid)
+			if err != nil {
+				t.Fatalf("AcquireAvoiding() returned error: %v", err)
+			}
+			if banned.Contains(lease.IP) {
+				t.Fatalf("AcquireAvoiding() returned the avoided address %v", lease.IP)
+			}
+			lease.Release()
+		}
+
+		if _, err := allocator.AcquireAvoiding(*prefix, 48, 0, func(net.IP) bool { return true }); err != ErrExhausted {
+			t.Errorf("AcquireAvoiding() returned %v when avoiding everything, expected ErrExhausted", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package alloc
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vlourme/go-proxy/internal/utils"
+)
+
+const (
+	StrategyRandom     string = "random"
+	StrategySequential string = "sequential"
+	StrategyLRU        string = "lru"
+)
+
+// lruCapacity is the maximum number of slots remembered by the LRU strategy per prefix.
+const lruCapacity = 65536
+
+// Strategy picks candidate addresses inside a prefix.
+//
+// Addresses are picked per slot: a subnet of length granularity inside the prefix
+// when the granularity is longer than the prefix, or a single address otherwise.
+type Strategy interface {
+	Next(prefix net.IPNet, granularity int) (net.IP, error)
+}
+
+// NewStrategy returns the strategy with the given name, defaulting to random.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", StrategyRandom:
+		return &Random{}, nil
+	case StrategySequential:
+		return &Sequential{cursors: make(map[string]uint64)}, nil
+	case StrategyLRU:
+		return &LRU{states: make(map[string]*lruState)}, nil
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy: %s", name)
+	}
+}
+
+// Random picks a random address inside the prefix.
+type Random struct{}
+
+func (s *Random) Next(prefix net.IPNet, granularity int) (net.IP, error) {
+	return utils.GenerateIPWithGranularity(prefix, granularity)
+}
+
+// Sequential walks the slots of the prefix in a round-robin fashion.
+type Sequential struct {
+	mu      sync.Mutex
+	cursors map[string]uint64
+}
+
+func (s *Sequential) Next(prefix net.IPNet, granularity int) (net.IP, error) {
+	key := prefix.String()
+
+	s.mu.Lock()
+	index := s.cursors[key]
+	s.cursors[key] = index + 1
+	s.mu.Unlock()
+
+	return slotHost(prefix, granularity, index)
+}
+
+// LRU picks the least recently used slot of the prefix. Slots never used
+// come first, then the slot used the longest time ago.
+type LRU struct {
+	mu     sync.Mutex
+	states map[string]*lruState
+}
+
+type lruState struct {
+	start  uint64
+	cursor uint64
+	order  *list.List
+}
+
+func (s *LRU) Next(prefix net.IPNet, granularity int) (net.IP, error) {
+	key := prefix.String()
+	count := utils.SubnetCount(prefix, slotLength(prefix, granularity))
+
+	s.mu.Lock()
+	state, ok := s.states[key]
+	if !ok {
+		state = &lruState{
+			start: uint64(utils.RandomInt(1 << 31)),
+			order: list.New(),
+		}
+		s.states[key] = state
+	}
+
+	var index uint64
+	if state.cursor < count {
+		// Too many slots to remember them all, forget the oldest one
+		if state.order.Len() >= lruCapacity {
+			state.order.Remove(state.order.Front())
+		}
+
+		index = (state.start + state.cursor) % count
+		state.cursor++
+		state.order.PushBack(index)
+	} else {
+		oldest := state.order.Front()
+		index = oldest.Value.(uint64)
+		state.order.MoveToBack(oldest)
+	}
+	s.mu.Unlock()
+
+	return slotHost(prefix, granularity, index)
+}
+
+// slotLength returns the length of a slot inside the prefix.
+func slotLength(prefix net.IPNet, granularity int) int {
+	ones, bits := prefix.Mask.Size()
+	if granularity <= ones {
+		return bits
+	}
+
+	return granularity
+}
+
+// slotHost returns a random host inside the slot at the given index.
+func slotHost(prefix net.IPNet, granularity int, index uint64) (net.IP, error) {
+	subnet, err := utils.SubnetAt(prefix, slotLength(prefix, granularity), index)
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.RandomHost(subnet)
+}
@@ -2,9 +2,14 @@ package auth
 
 import (
 	"encoding/base64"
+	"errors"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/vlourme/go-proxy/internal/config"
 	"github.com/vlourme/go-proxy/internal/http"
 )
 
@@ -13,6 +18,31 @@ const (
 	ParamTimeout  string = "timeout"
 	ParamLocation string = "country"
 	ParamFallback string = "fallback"
+	ParamPool     string = "pool"
+	ParamIP       string = "ip"
+	ParamFamily   string = "family"
+	ParamIdle     string = "idle"
+	ParamLifetime string = "lifetime"
+	ParamRepin    string = "repin"
+)
+
+// reservedParams are the parameters which are not pool tags
+var reservedParams = map[string]bool{
+	ParamSession:  true,
+	ParamTimeout:  true,
+	ParamFallback: true,
+	ParamPool:     true,
+	ParamIP:       true,
+	ParamFamily:   true,
+	ParamIdle:     true,
+	ParamLifetime: true,
+	ParamRepin:    true,
+}
+
+var (
+	ErrInvalidIP      = errors.New("invalid pinned IP")
+	ErrInvalidFamily  = errors.New("invalid address family, expected 4, 6 or any")
+	ErrInvalidTimeout = errors.New("invalid timeout, expected a positive number of seconds")
 )
 
 var sessionRegex = regexp.MustCompile(`^[a-zA-Z0-9]{6,24}$`)
@@ -75,3 +105,72 @@ func VerifySession(result map[string]string) bool {
 
 	return sessionRegex.MatchString(session)
 }
+
+// GetSelector returns the pool selector from the parameters.
+// Every parameter which is not reserved is a tag, e.g. -country-ch or -city-zurich.
+func GetSelector(params map[string]string) config.Selector {
+	selector := config.Selector{
+		Pool: params[ParamPool],
+		Tags: make(map[string]string),
+	}
+
+	for key, value := range params {
+		if !reservedParams[key] {
+			selector.Tags[key] = value
+		}
+	}
+
+	return selector
+}
+
+// GetPinnedIP returns the egress IP pinned by the user, if any.
+// Colons can't be used in usernames, IPv6 addresses are written
+// with underscores instead, e.g. -ip-2a14_dead_beef__1234.
+func GetPinnedIP(params map[string]string) (net.IP, error) {
+	value, ok := params[ParamIP]
+	if !ok {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(strings.ReplaceAll(value, "_", ":"))
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+
+	return ip, nil
+}
+
+// GetFamily returns the address family requested by the user, e.g. -family-6.
+// Any family is allowed if the parameter is missing.
+func GetFamily(params map[string]string) (config.Family, error) {
+	switch params[ParamFamily] {
+	case "", "any":
+		return config.FamilyAny, nil
+	case "4":
+		return config.FamilyIPv4, nil
+	case "6":
+		return config.FamilyIPv6, nil
+	default:
+		return config.FamilyAny, ErrInvalidFamily
+	}
+}
+
+// GetTimeouts returns the idle and lifetime timeouts requested by the user in seconds,
+// e.g. -idle-30-lifetime-3600. Missing timeouts are zero.
+func GetTimeouts(params map[string]string) (time.Duration, time.Duration, error) {
+	var timeouts [2]time.Duration
+	for i, param := range []string{ParamIdle, ParamLifetime} {
+		value, ok := params[param]
+		if !ok {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return 0, 0, ErrInvalidTimeout
+		}
+		timeouts[i] = time.Duration(seconds) * time.Second
+	}
+
+	return timeouts[0], timeouts[1], nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+func TestGetPinnedIP(t *testing.T) {
+	tests := map[string]string{
+		"2a14_dead_beef__1234": "2a14:dead:beef::1234",
+		"2a14:dead:beef::1234": "2a14:dead:beef::1234",
+		"1.2.3.4":              "1.2.3.4",
+	}
+
+	for value, expected := range tests {
+		ip, err := GetPinnedIP(GetParams("ip-" + value))
+		if err != nil {
+			t.Fatalf("GetPinnedIP(%s) returned error: %v", value, err)
+		}
+
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("GetPinnedIP(%s) = %v, expected %s", value, ip, expected)
+		}
+	}
+
+	if _, err := GetPinnedIP(GetParams("ip-nope")); err != ErrInvalidIP {
+		t.Errorf("GetPinnedIP(nope) returned %v, expected ErrInvalidIP", err)
+	}
+
+	if ip, err := GetPinnedIP(GetParams("session-abcdef123")); ip != nil || err != nil {
+		t.Errorf("GetPinnedIP() returned %v, %v without pinned IP", ip, err)
+	}
+}
+
+func TestGetFamily(t *testing.T) {
+	tests := map[string]config.Family{
+		"":                    config.FamilyAny,
+		"family-any":          config.FamilyAny,
+		"family-4":            config.FamilyIPv4,
+		"family-6":            config.FamilyIPv6,
+		"country-ch-family-6": config.FamilyIPv6,
+	}
+
+	for params, expected := range tests {
+		family, err := GetFamily(GetParams(params))
+		if err != nil {
+			t.Fatalf("GetFamily(%s) returned error: %v", params, err)
+		}
+		if family != expected {
+			t.Errorf("GetFamily(%s) = %d, expected %d", params, family, expected)
+		}
+	}
+
+	if _, err := GetFamily(GetParams("family-5")); err != ErrInvalidFamily {
+		t.Errorf("GetFamily(family-5) returned %v, expected ErrInvalidFamily", err)
+	}
+}
+
+func TestGetTimeouts(t *testing.T) {
+	idle, lifetime, err := GetTimeouts(GetParams("idle-30-lifetime-3600"))
+	if err != nil || idle != 30*time.Second || lifetime != time.Hour {
+		t.Errorf("GetTimeouts() returned %v, %v, %v, expected 30s, 1h", idle, lifetime, err)
+	}
+
+	if idle, lifetime, err := GetTimeouts(GetParams("session-abcdef123")); idle != 0 || lifetime != 0 || err != nil {
+		t.Errorf("GetTimeouts() returned %v, %v, %v without timeouts", idle, lifetime, err)
+	}
+
+	for _, params := range []string{"idle-0", "idle-abc", "lifetime--5"} {
+		if _, _, err := GetTimeouts(GetParams(params)); err != ErrInvalidTimeout {
+			t.Errorf("GetTimeouts(%s) returned %v, expected ErrInvalidTimeout", params, err)
+		}
+	}
+}
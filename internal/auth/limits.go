@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/phuslu/lru"
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+// limitsTTL is how long the limits read from Redis are cached.
+const limitsTTL = 30 * time.Second
+
+var limitsCache = lru.NewTTLCache[string, config.Limits](64 * 1024)
+
+// GetLimits returns the limits of the user: the ones of their policy, overridden by
+// the fields set in their Redis record when enabled.
+func GetLimits(username string) config.Limits {
+	limits := config.GetPolicies().Limits(username)
+
+	cfg := config.Get()
+	if cfg.Auth.Type != config.AuthTypeRedis || cfg.Auth.Redis.LimitsPrefix == "" {
+		return limits
+	}
+
+	return limits.Merge(getRedisLimits(cfg.Auth.Redis.LimitsPrefix + username))
+}
+
+// getRedisLimits returns the limits stored in the Redis hash, cached for limitsTTL.
+// Missing records and errors are no limits.
+func getRedisLimits(key string) config.Limits {
+	if limits, ok := limitsCache.Get(key); ok {
+		return limits
+	}
+
+	var limits config.Limits
+	if err := GetRedisClient().HGetAll(context.Background(), key).Scan(&limits); err != nil {
+		log.Error().Err(err).Str("key", key).Msg("Failed to read limits")
+	}
+
+	limitsCache.Set(key, limits, limitsTTL)
+	return limits
+}
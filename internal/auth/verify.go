@@ -2,10 +2,13 @@ package auth
 
 import (
 	"context"
+	"errors"
 
 	"github.com/vlourme/go-proxy/internal/config"
 )
 
+var ErrFamilyMismatch = errors.New("pinned IP is not of the requested address family")
+
 // VerifyCredentials verifies the credentials of the user
 func Verify(username, password string) bool {
 	switch config.Get().Auth.Type {
@@ -33,3 +36,31 @@ func verifyRedisCredentials(username, password string) bool {
 
 	return client.Get(context.Background(), username).Val() == password
 }
+
+// VerifyParams verifies the parameters restricted by the config.
+//
+//   - The address family must be 4, 6 or any.
+//   - The idle and lifetime timeouts must be positive numbers of seconds.
+//   - A pinned IP must be of the requested family. Whether the user may use it is
+//     checked when dialing.
+func VerifyParams(params map[string]string) error {
+	family, err := GetFamily(params)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := GetTimeouts(params); err != nil {
+		return err
+	}
+
+	ip, err := GetPinnedIP(params)
+	if err != nil || ip == nil {
+		return err
+	}
+
+	if !family.Matches(ip) {
+		return ErrFamilyMismatch
+	}
+
+	return nil
+}
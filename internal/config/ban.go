@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	// DefaultBanBodyLimit is the default number of bytes of the response body matched against the patterns.
+	DefaultBanBodyLimit = 16 * 1024
+	// DefaultBanCooldown is the default period during which a banned egress is avoided for the host.
+	DefaultBanCooldown = 10 * time.Minute
+)
+
+// BanConfig is the configuration of the detection of the egress addresses banned by targets.
+type BanConfig struct {
+	// Enabled is whether the responses of plain HTTP requests are inspected.
+	Enabled bool `yaml:"enabled"`
+	// StatusCodes are the status codes banning the egress, e.g. 403 and 429.
+	StatusCodes []int `yaml:"status_codes"`
+	// Patterns are the regular expressions matched against the start of the body, e.g. "(?i)captcha".
+	Patterns []string `yaml:"patterns"`
+	// BodyLimit is the number of bytes of the body matched against the patterns, defaults to 16 KiB.
+	BodyLimit int `yaml:"body_limit"`
+	// Cooldown is the period in seconds during which a banned egress is avoided for the host, defaults to 600.
+	Cooldown int `yaml:"cooldown"`
+	// Subnet is whether the /64 of banned IPv6 addresses is banned instead of the address.
+	Subnet bool `yaml:"subnet"`
+	// Repin is whether sessions banned by a host get a new address on their next request to it.
+	Repin bool `yaml:"repin"`
+}
+
+// BanRules tell whether a response of a target bans the egress.
+type BanRules struct {
+	Enabled     bool
+	StatusCodes map[int]bool
+	Patterns    []*regexp.Regexp
+	BodyLimit   int
+	Cooldown    time.Duration
+	Subnet      bool
+	Repin       bool
+}
+
+// newBanRules parses the ban detection config
+func newBanRules(cfg BanConfig) (*BanRules, error) {
+	rules := &BanRules{
+		Enabled:     cfg.Enabled,
+		StatusCodes: make(map[int]bool, len(cfg.StatusCodes)),
+		BodyLimit:   cfg.BodyLimit,
+		Cooldown:    time.Duration(cfg.Cooldown) * time.Second,
+		Subnet:      cfg.Subnet,
+		Repin:       cfg.Repin,
+	}
+	if rules.BodyLimit <= 0 {
+		rules.BodyLimit = DefaultBanBodyLimit
+	}
+	if rules.Cooldown <= 0 {
+		rules.Cooldown = DefaultBanCooldown
+	}
+
+	for _, code := range cfg.StatusCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code: %d", code)
+		}
+		rules.StatusCodes[code] = true
+	}
+
+	for _, pattern := range cfg.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		rules.Patterns = append(rules.Patterns, re)
+	}
+
+	return rules, nil
+}
+
+// MatchStatus returns whether the status code bans the egress
+func (r *BanRules) MatchStatus(code int) bool {
+	return r.StatusCodes[code]
+}
+
+// MatchBody returns the pattern matching the start of the body, if any
+func (r *BanRules) MatchBody(body []byte) (string, bool) {
+	for _, re := range r.Patterns {
+		if re.Match(body) {
+			return re.String(), true
+		}
+	}
+
+	return "", false
+}
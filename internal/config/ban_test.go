@@ -0,0 +1,26 @@
+package config
+
+import "testing"
+
+func TestBanRules(t *testing.T) {
+	rules, err := newBanRules(BanConfig{Enabled: true, StatusCodes: []int{403, 429}, Patterns: []string{`(?i)captcha`}})
+	if err != nil {
+		t.Fatalf("newBanRules() returned error: %v", err)
+	}
+
+	if !rules.MatchStatus(429) || rules.MatchStatus(200) {
+		t.Errorf("MatchStatus() didn't match only the configured status codes")
+	}
+	if pattern, ok := rules.MatchBody([]byte("<title>Captcha</title>")); !ok || pattern != `(?i)captcha` {
+		t.Errorf("MatchBody() = %q, %v, expected the captcha pattern", pattern, ok)
+	}
+	if rules.BodyLimit != DefaultBanBodyLimit || rules.Cooldown != DefaultBanCooldown {
+		t.Errorf("newBanRules() returned %d, %s, expected the default body limit and cool-down", rules.BodyLimit, rules.Cooldown)
+	}
+
+	for _, cfg := range []BanConfig{{StatusCodes: []int{42}}, {Patterns: []string{"("}}} {
+		if _, err := newBanRules(cfg); err == nil {
+			t.Errorf("newBanRules(%+v) returned no error", cfg)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/geo"
+	"github.com/vlourme/go-proxy/internal/utils"
+)
+
+// maxGeoSubnets is the maximum number of sub-prefixes classified per prefix.
+const maxGeoSubnets = 4096
+
+// classify looks up the location of the prefixes of every pool but the fallback ones,
+// or of their sub-prefixes of length granularity, and adds a pool per pool and location:
+//
+//   - The pool is named "<pool>:<country>:<region>:<city>".
+//   - It is tagged with the country, region and city of the location, unless the
+//     tag is set on the original pool.
+//   - It shares the allocator and the prefix weights of the original pool.
+func (r *Registry) classify(db geo.Database, granularity int) {
+	classified := map[string]*Pool{}
+	order := []*Pool{}
+
+	for _, pool := range r.pools {
+		if pool.Fallback {
+			continue
+		}
+
+		for i, prefix := range pool.Prefixes {
+			ones, _ := prefix.Mask.Size()
+			length := granularity
+			if utils.SubnetCount(prefix, length) > maxGeoSubnets {
+				length = ones + 12
+				log.Warn().
+					Str("prefix", prefix.String()).
+					Int("granularity", length).
+					Msg("Too many sub-prefixes to classify, using a coarser granularity")
+			}
+
+			for index := range utils.SubnetCount(prefix, length) {
+				subnet, err := utils.SubnetAt(prefix, length, index)
+				if err != nil {
+					continue
+				}
+
+				location, ok := db.Lookup(subnet.IP)
+				if !ok {
+					continue
+				}
+
+				name := fmt.Sprintf("%s:%s:%s:%s", pool.Name, location.Country, location.Region, location.City)
+				geoPool, ok := classified[name]
+				if !ok {
+					tags := location.Tags()
+					maps.Copy(tags, pool.Tags)
+
+					geoPool = &Pool{Name: name, Tags: tags, Derived: true, Parent: pool.Name, Allocator: pool.Allocator}
+					classified[name] = geoPool
+					order = append(order, geoPool)
+				}
+
+				geoPool.Prefixes = append(geoPool.Prefixes, subnet)
+				geoPool.Weights = append(geoPool.Weights, pool.Weights[i])
+			}
+		}
+	}
+
+	for _, pool := range order {
+		log.Info().
+			Str("pool", pool.Name).
+			Int("prefixes", len(pool.Prefixes)).
+			Msg("Classified prefixes by location")
+	}
+
+	r.pools = append(r.pools, order...)
+	r.indexTags()
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vlourme/go-proxy/internal/utils"
+)
+
+// defaultDenied are the destinations denied unless allowed: unspecified, loopback, private,
+// shared, link-local (including the cloud metadata address 169.254.169.254), multicast,
+// reserved and unique local addresses.
+var defaultDenied = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// loopback are the loopback destinations, allowed in debug mode.
+var loopback = []string{"127.0.0.0/8", "::1/128"}
+
+var (
+	// wellKnownPrefix is the NAT64 prefix of RFC 6052.
+	wellKnownPrefix = net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+	// localUsePrefix is the local-use NAT64 prefix of RFC 8215.
+	localUsePrefix = net.IPNet{IP: net.ParseIP("64:ff9b:1::"), Mask: net.CIDRMask(48, 128)}
+	// sixToFourPrefix is the 6to4 prefix, embedding the IPv4 address after it (RFC 3056).
+	sixToFourPrefix = net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+	// teredoPrefix is the Teredo prefix, embedding the obfuscated IPv4 address of the client
+	// in the last 32 bits (RFC 4380).
+	teredoPrefix = net.IPNet{IP: net.ParseIP("2001::"), Mask: net.CIDRMask(32, 128)}
+)
+
+// embeddedIPv4 returns the IPv4 address embedded into the IPv6 address by NAT64, under the
+// well-known, local-use or configured DNS64 prefix, or by 6to4 and Teredo, nil if none.
+func embeddedIPv4(ip net.IP, dns64 *net.IPNet) net.IP {
+	ip6 := ip.To16()
+	if ip6 == nil || ip.To4() != nil {
+		return nil
+	}
+
+	for _, prefix := range []*net.IPNet{&wellKnownPrefix, &localUsePrefix, dns64} {
+		if prefix == nil || !prefix.Contains(ip) {
+			continue
+		}
+		if ip4, err := utils.ExtractIPv4(*prefix, ip); err == nil {
+			return ip4
+		}
+	}
+
+	switch {
+	case sixToFourPrefix.Contains(ip):
+		return net.IPv4(ip6[2], ip6[3], ip6[4], ip6[5]).To4()
+	case teredoPrefix.Contains(ip):
+		return net.IPv4(^ip6[12], ^ip6[13], ^ip6[14], ^ip6[15]).To4()
+	}
+
+	return nil
+}
+
+// Guard decides which destination addresses may be dialed.
+type Guard struct {
+	disabled bool
+	deny     []*net.IPNet
+	allow    []*net.IPNet
+	dns64    *net.IPNet
+}
+
+// newGuard returns the guard of the config. The prefixes of the pools are denied,
+// so that the proxy can't be used to reach itself.
+func newGuard(cfg *Config, pools *Registry, dns64 *net.IPNet) (*Guard, error) {
+	g := &Guard{disabled: cfg.DestinationGuard.Disable, dns64: dns64}
+
+	denied := append([]string{}, defaultDenied...)
+	if !cfg.DebugMode {
+		denied = append(denied, loopback...)
+	}
+	denied = append(denied, cfg.DestinationGuard.Deny...)
+
+	for _, cidr := range denied {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing denied destination: %w", err)
+		}
+		g.deny = append(g.deny, ipnet)
+	}
+
+	for _, prefix := range pools.Prefixes() {
+		g.deny = append(g.deny, &prefix)
+	}
+
+	for _, cidr := range cfg.DestinationGuard.Allow {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing allowed destination: %w", err)
+		}
+		g.allow = append(g.allow, ipnet)
+	}
+
+	return g, nil
+}
+
+// Allows returns whether the destination may be dialed. Allowed CIDRs take precedence
+// over denied ones. IPv4-mapped addresses are checked as IPv4 addresses, and IPv4 addresses
+// embedded by NAT64, 6to4 or Teredo as well as the addresses embedding them, whether DNS64
+// is configured or not: literal addresses can reach them through any upstream gateway.
+func (g *Guard) Allows(ip net.IP) bool {
+	if g.disabled {
+		return true
+	}
+
+	if ip4 := embeddedIPv4(ip, g.dns64); ip4 != nil && !g.allows(ip4) {
+		return false
+	}
+
+	return g.allows(ip)
+}
+
+func (g *Guard) allows(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, ipnet := range g.allow {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, ipnet := range g.deny {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGuardAllows(t *testing.T) {
+	registry := newTestRegistry(t)
+	_, dns64, _ := net.ParseCIDR("2001:db8:64::/96")
+
+	var cfg Config
+	cfg.DestinationGuard.Deny = []string{"203.0.113.0/24"}
+	cfg.DestinationGuard.Allow = []string{"10.1.2.0/24"}
+
+	guard, err := newGuard(&cfg, registry, dns64)
+	if err != nil {
+		t.Fatalf("newGuard() returned error: %v", err)
+	}
+
+	tests := map[string]bool{
+		"1.1.1.1":                              true,
+		"2606:4700::1111":                      true,
+		"127.0.0.1":                            false,
+		"::1":                                  false,
+		"10.0.0.1":                             false,
+		"10.1.2.3":                             true,
+		"172.16.5.4":                           false,
+		"192.168.1.1":                          false,
+		"169.254.169.254":                      false,
+		"fe80::1":                              false,
+		"fd00::1":                              false,
+		"::ffff:127.0.0.1":                     false,
+		"203.0.113.7":                          false,
+		"2001:db8:1::1":                        false,
+		"192.0.2.1":                            false,
+		"2001:db8:64::a00:1":                   false,
+		"2001:db8:64::101:101":                 true,
+		"2001:db8:ffff::1":                     true,
+		"::":                                   false,
+		"0.0.0.0":                              false,
+		"100.64.0.1":                           false,
+		"ff02::1":                              false,
+		"224.0.0.1":                            false,
+		"64:ff9b::a9fe:a9fe":                   false,
+		"64:ff9b::a00:1":                       false,
+		"64:ff9b::101:101":                     true,
+		"64:ff9b:1:a00:1::":                    false,
+		"2002:a9fe:a9fe::1":                    false,
+		"2002:101:101::1":                      true,
+		"2001:0:4136:e378:8000:63bf:f5ff:fffe": false,
+		"2001:0:4136:e378:8000:63bf:fefe:fefe": true,
+	}
+
+	for ip, expected := range tests {
+		if allowed := guard.Allows(net.ParseIP(ip)); allowed != expected {
+			t.Errorf("Allows(%s) = %v, expected %v", ip, allowed, expected)
+		}
+	}
+
+	// Without DNS64, the addresses embedded by NAT64 gateways are checked anyway
+	guard, err = newGuard(&cfg, registry, nil)
+	if err != nil {
+		t.Fatalf("newGuard() returned error: %v", err)
+	}
+	for _, ip := range []string{"64:ff9b::a9fe:a9fe", "64:ff9b::a00:1", "2002:a00:1::1"} {
+		if guard.Allows(net.ParseIP(ip)) {
+			t.Errorf("Allows(%s) = true without DNS64", ip)
+		}
+	}
+
+	cfg.DebugMode = true
+	guard, err = newGuard(&cfg, registry, nil)
+	if err != nil {
+		t.Fatalf("newGuard() returned error: %v", err)
+	}
+	if !guard.Allows(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Allows(127.0.0.1) = false in debug mode")
+	}
+
+	cfg.DestinationGuard.Disable = true
+	guard, _ = newGuard(&cfg, registry, nil)
+	if !guard.Allows(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Allows(10.0.0.1) = false with the guard disabled")
+	}
+
+	cfg.DestinationGuard.Deny = []string{"nope"}
+	if _, err := newGuard(&cfg, registry, nil); err == nil {
+		t.Errorf("newGuard() returned no error for an invalid CIDR")
+	}
+}
@@ -0,0 +1,288 @@
+package config
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultHealthFailures is the default number of consecutive failures before a prefix is unhealthy.
+	DefaultHealthFailures = 5
+	// DefaultHealthTargets is the default number of distinct targets the consecutive failures must span.
+	DefaultHealthTargets = 3
+	// DefaultHealthMinBackoff is the default first period during which an unhealthy prefix is avoided.
+	DefaultHealthMinBackoff = 10 * time.Second
+	// DefaultHealthMaxBackoff is the default longest period during which an unhealthy prefix is avoided.
+	DefaultHealthMaxBackoff = 5 * time.Minute
+)
+
+// Health states of a prefix.
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+	HealthProbing   = "probing"
+)
+
+// HealthConfig is the configuration of the prefix health tracking.
+type HealthConfig struct {
+	// Disable is whether every prefix stays in rotation whatever its failures.
+	Disable bool `yaml:"disable"`
+	// Failures is the number of consecutive failures before a prefix is unhealthy, defaults to 5.
+	Failures int `yaml:"failures"`
+	// Targets is the number of distinct targets the consecutive failures must span, defaults to 3.
+	Targets int `yaml:"targets"`
+	// MinBackoff is the first period in seconds during which an unhealthy prefix is avoided, defaults to 10.
+	MinBackoff int `yaml:"min_backoff"`
+	// MaxBackoff is the longest period in seconds during which an unhealthy prefix is avoided, defaults to 300.
+	MaxBackoff int `yaml:"max_backoff"`
+}
+
+// PrefixHealth is the health of a prefix, as exposed by the stats.
+type PrefixHealth struct {
+	Prefix      string     `json:"prefix"`
+	State       string     `json:"state"`
+	Successes   int64      `json:"successes"`
+	Failures    int64      `json:"failures"`
+	FailureRate float64    `json:"failure_rate"`
+	Consecutive int        `json:"consecutive_failures"`
+	DownUntil   *time.Time `json:"down_until,omitempty"`
+}
+
+// prefixHealth is the health of a prefix.
+type prefixHealth struct {
+	state       string
+	successes   int64
+	failures    int64
+	consecutive int
+	// targets are the distinct targets of the consecutive failures, up to the configured number
+	targets map[string]struct{}
+	// trips is the number of times in a row the prefix became unhealthy
+	trips     int
+	downUntil time.Time
+	// probeUntil is when the probe in flight is considered lost
+	probeUntil time.Time
+}
+
+// HealthTracker tracks the outcome of the connections dialed from each prefix, and takes the
+// prefixes failing consecutively out of rotation.
+//
+//   - After the configured number of consecutive failures, spanning the configured number of
+//     distinct targets, a prefix is unhealthy and avoided for a back-off period doubling every
+//     time it fails again. A dead target alone doesn't take the prefixes out of rotation.
+//   - Once the period is over, the prefix is probed: a single request is sent through it, its
+//     success makes the prefix healthy again.
+//   - Refused connections are successes, the target answered through the route of the prefix.
+type HealthTracker struct {
+	mu       sync.Mutex
+	cfg      HealthConfig
+	prefixes map[string]*prefixHealth
+	now      func() time.Time
+}
+
+var prefixHealthTracker = newHealthTracker(HealthConfig{})
+
+// newHealthTracker returns a tracker with every prefix healthy
+func newHealthTracker(cfg HealthConfig) *HealthTracker {
+	t := &HealthTracker{prefixes: make(map[string]*prefixHealth), now: time.Now}
+	t.configure(cfg)
+	return t
+}
+
+// configure sets the configuration of the tracker, keeping the health of the prefixes
+func (t *HealthTracker) configure(cfg HealthConfig) {
+	if cfg.Failures <= 0 {
+		cfg.Failures = DefaultHealthFailures
+	}
+	if cfg.Targets <= 0 {
+		cfg.Targets = DefaultHealthTargets
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = int(DefaultHealthMinBackoff / time.Second)
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = int(DefaultHealthMaxBackoff / time.Second)
+	}
+	cfg.MaxBackoff = max(cfg.MaxBackoff, cfg.MinBackoff)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cfg = cfg
+}
+
+// backoff returns the period during which a prefix unhealthy for the number of trips is avoided
+func (t *HealthTracker) backoff(trips int) time.Duration {
+	minBackoff := time.Duration(t.cfg.MinBackoff) * time.Second
+	maxBackoff := time.Duration(t.cfg.MaxBackoff) * time.Second
+
+	return min(minBackoff<<min(trips-1, 16), maxBackoff)
+}
+
+// Report records the outcome of a connection dialed from the prefix to the target
+func (t *HealthTracker) Report(prefix net.IPNet, target net.IP, err error) {
+	failed, ok := isPrefixFailure(err)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cfg.Disable {
+		return
+	}
+
+	key := prefix.String()
+	h, ok := t.prefixes[key]
+	if !ok {
+		h = &prefixHealth{state: HealthHealthy}
+		t.prefixes[key] = h
+	}
+
+	if !failed {
+		h.successes++
+		h.consecutive = 0
+		h.targets = nil
+		if h.state != HealthHealthy {
+			log.Info().Str("prefix", key).Str("from", h.state).Msg("Prefix is healthy again")
+			h.state = HealthHealthy
+			h.trips = 0
+			h.downUntil = time.Time{}
+		}
+		return
+	}
+
+	h.failures++
+	h.consecutive++
+	if len(h.targets) < t.cfg.Targets {
+		if h.targets == nil {
+			h.targets = make(map[string]struct{}, t.cfg.Targets)
+		}
+		h.targets[target.String()] = struct{}{}
+	}
+
+	// A failed probe puts the prefix back out of rotation at once
+	tripped := h.consecutive >= t.cfg.Failures && len(h.targets) >= t.cfg.Targets
+	if h.state == HealthProbing || (h.state == HealthHealthy && tripped) {
+		h.trips++
+		backoff := t.backoff(h.trips)
+		h.state = HealthUnhealthy
+		h.downUntil = t.now().Add(backoff)
+
+		log.Warn().
+			Str("prefix", key).
+			Int("failures", h.consecutive).
+			Int("targets", len(h.targets)).
+			Dur("backoff", backoff).
+			Msg("Prefix is unhealthy, taken out of rotation")
+	}
+}
+
+// available returns whether the prefix can be picked: healthy, or due for a probe
+func (t *HealthTracker) available(h *prefixHealth) bool {
+	switch h.state {
+	case HealthUnhealthy:
+		return !t.now().Before(h.downUntil)
+	case HealthProbing:
+		return !t.now().Before(h.probeUntil)
+	default:
+		return true
+	}
+}
+
+// Available returns whether the prefix is in rotation
+func (t *HealthTracker) Available(prefix net.IPNet) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.prefixes[prefix.String()]
+	return t.cfg.Disable || !ok || t.available(h)
+}
+
+// Picked records that the prefix was picked. The first pick of a prefix due for a probe
+// is the probe, the prefix is out of rotation until its outcome is reported.
+func (t *HealthTracker) Picked(prefix net.IPNet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := prefix.String()
+	h, ok := t.prefixes[key]
+	if !ok || h.state == HealthHealthy || !t.available(h) {
+		return
+	}
+
+	if h.state == HealthUnhealthy {
+		log.Info().Str("prefix", key).Msg("Probing unhealthy prefix")
+	}
+
+	// Lost probes, e.g. of requests failing before dialing, are retried after the minimum back-off
+	h.state = HealthProbing
+	h.probeUntil = t.now().Add(t.backoff(1))
+}
+
+// Stats returns the health of the prefixes which dialed connections, sorted by prefix
+func (t *HealthTracker) Stats() []PrefixHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make([]PrefixHealth, 0, len(t.prefixes))
+	for key, h := range t.prefixes {
+		stat := PrefixHealth{
+			Prefix:      key,
+			State:       h.state,
+			Successes:   h.successes,
+			Failures:    h.failures,
+			Consecutive: h.consecutive,
+		}
+		if total := h.successes + h.failures; total > 0 {
+			stat.FailureRate = float64(h.failures) / float64(total)
+		}
+		if h.state == HealthUnhealthy {
+			downUntil := h.downUntil
+			stat.DownUntil = &downUntil
+		}
+		stats = append(stats, stat)
+	}
+
+	slices.SortFunc(stats, func(a, b PrefixHealth) int {
+		return cmp.Compare(a.Prefix, b.Prefix)
+	})
+
+	return stats
+}
+
+// isPrefixFailure returns whether the outcome of a dial is a failure of the prefix, and whether
+// it tells anything about the prefix at all: canceled attempts which lost a race don't.
+func isPrefixFailure(err error) (failed bool, ok bool) {
+	switch {
+	case err == nil:
+		return false, true
+	case errors.Is(err, context.Canceled):
+		return false, false
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return false, true
+	default:
+		return true, true
+	}
+}
+
+// GetHealth returns the health tracker of the prefixes, kept across reloads
+func GetHealth() *HealthTracker {
+	return prefixHealthTracker
+}
+
+// ReportDial records the outcome of a connection dialed from the local address to the target
+// in the health of every prefix containing it
+func ReportDial(local, target net.IP, err error) {
+	for _, prefix := range GetPools().PrefixesOf(local) {
+		prefixHealthTracker.Report(prefix, target, err)
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// dialOutcomes returns the errors of a connection established, refused and timed out,
+// dialed to local listeners
+func dialOutcomes(t *testing.T) (established, refused, timedOut error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned error: %v", err)
+	}
+	defer listener.Close()
+
+	conn, established := net.Dial("tcp", listener.Addr().String())
+	if established == nil {
+		conn.Close()
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned error: %v", err)
+	}
+	closed.Close()
+	_, refused = net.Dial("tcp", closed.Addr().String())
+
+	dialer := net.Dialer{Deadline: time.Now().Add(-time.Second)}
+	_, timedOut = dialer.Dial("tcp", listener.Addr().String())
+
+	if established != nil || refused == nil || timedOut == nil {
+		t.Fatalf("dialing local listeners returned %v, %v, %v", established, refused, timedOut)
+	}
+
+	return established, refused, timedOut
+}
+
+func TestHealthTracker(t *testing.T) {
+	established, refused, timedOut := dialOutcomes(t)
+
+	now := time.Now()
+	tracker := newHealthTracker(HealthConfig{Failures: 3, Targets: 2, MinBackoff: 10, MaxBackoff: 15})
+	tracker.now = func() time.Time { return now }
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/48")
+	targets := 0
+	report := func(errs ...error) {
+		for _, err := range errs {
+			targets++
+			tracker.Report(*prefix, net.IPv4(192, 0, 2, byte(targets)), err)
+		}
+	}
+
+	// Refused connections reached the target through the prefix
+	report(timedOut, timedOut, refused, timedOut, timedOut)
+	if !tracker.Available(*prefix) {
+		t.Fatalf("Available() returned false before 3 consecutive failures")
+	}
+
+	report(timedOut)
+	if tracker.Available(*prefix) {
+		t.Fatalf("Available() returned true after 3 consecutive failures")
+	}
+
+	// A single probe is sent once the back-off is over
+	now = now.Add(10 * time.Second)
+	if !tracker.Available(*prefix) {
+		t.Fatalf("Available() returned false after the back-off")
+	}
+	tracker.Picked(*prefix)
+	if tracker.Available(*prefix) {
+		t.Errorf("Available() returned true while probing")
+	}
+
+	// A failed probe doubles the back-off, up to the maximum
+	report(timedOut)
+	now = now.Add(10 * time.Second)
+	if tracker.Available(*prefix) {
+		t.Errorf("Available() returned true before the doubled back-off")
+	}
+	now = now.Add(5 * time.Second)
+	if !tracker.Available(*prefix) {
+		t.Errorf("Available() returned false after the maximum back-off")
+	}
+
+	tracker.Picked(*prefix)
+	report(established)
+	if !tracker.Available(*prefix) {
+		t.Errorf("Available() returned false after a successful probe")
+	}
+
+	stats := tracker.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("Stats() returned %d prefixes, expected 1", len(stats))
+	}
+	expected := PrefixHealth{Prefix: "2001:db8::/48", State: HealthHealthy, Successes: 2, Failures: 6, FailureRate: 0.75}
+	if stats[0] != expected {
+		t.Errorf("Stats() = %+v, expected %+v", stats[0], expected)
+	}
+}
+
+func TestHealthTrackerDeadTarget(t *testing.T) {
+	_, _, timedOut := dialOutcomes(t)
+
+	tracker := newHealthTracker(HealthConfig{Failures: 3, Targets: 2})
+	_, prefix, _ := net.ParseCIDR("2001:db8::/48")
+
+	// Retries to a dead target fail from every prefix, the prefix isn't to blame
+	dead := net.ParseIP("192.0.2.1")
+	for range 10 {
+		tracker.Report(*prefix, dead, timedOut)
+	}
+	if !tracker.Available(*prefix) {
+		t.Fatalf("Available() returned false after failures to a single target")
+	}
+
+	tracker.Report(*prefix, net.ParseIP("192.0.2.2"), timedOut)
+	if tracker.Available(*prefix) {
+		t.Errorf("Available() returned true after failures to 2 targets")
+	}
+}
+
+func TestPickPrefixHealth(t *testing.T) {
+	_, _, timedOut := dialOutcomes(t)
+
+	tracker := newHealthTracker(HealthConfig{Failures: 1, Targets: 1})
+	target := net.ParseIP("192.0.2.1")
+	pool, err := newPool(PoolConfig{Name: "test", Prefixes: []PrefixConfig{{CIDR: "2001:db8:1::/48"}, {CIDR: "2001:db8:2::/48"}}})
+	if err != nil {
+		t.Fatalf("newPool() returned error: %v", err)
+	}
+	broken := pool.Prefixes[0]
+
+	tracker.Report(broken, target, timedOut)
+	for range 50 {
+		_, prefix, err := pickPrefix([]*Pool{pool}, FamilyAny, tracker)
+		if err != nil {
+			t.Fatalf("pickPrefix() returned error: %v", err)
+		}
+		if prefix.String() == broken.String() {
+			t.Fatalf("pickPrefix() returned the unhealthy prefix %s", prefix.String())
+		}
+	}
+
+	// Every prefix is unhealthy, they are picked anyway
+	tracker.Report(pool.Prefixes[1], target, timedOut)
+	if _, _, err := pickPrefix([]*Pool{pool}, FamilyAny, tracker); err != nil {
+		t.Errorf("pickPrefix() returned %v with every prefix unhealthy, expected a prefix", err)
+	}
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strings"
+)
+
+// OverrideConfig is a DNS override rule.
+type OverrideConfig struct {
+	// Match is a hostname, a wildcard domain (*.example.com) or a CIDR of resolved addresses.
+	Match string `yaml:"match"`
+	// Addresses are the addresses replacing the resolution, or the resolved address.
+	Addresses []string `yaml:"addresses"`
+	// Priority orders the rules, higher first. Rules of the same priority keep their order.
+	Priority int `yaml:"priority"`
+	// Users restricts the rule to these users, empty for any.
+	Users []string `yaml:"users"`
+	// Tags restricts the rule to the requests selecting these tags, e.g. country: ch.
+	Tags map[string]string `yaml:"tags"`
+}
+
+// Override is a parsed DNS override rule.
+type Override struct {
+	// Host is the hostname, or the parent domain of a wildcard.
+	Host string
+	// Wildcard is whether subdomains of the host match instead of the host.
+	Wildcard bool
+	// CIDR is the network of resolved addresses matched, nil for hostname rules.
+	CIDR      *net.IPNet
+	Addresses []net.IP
+	Priority  int
+	Users     []string
+	Tags      map[string]string
+}
+
+// OverrideScope is the user and tags of a request, to which the rules may be restricted.
+type OverrideScope struct {
+	User string
+	Tags map[string]string
+}
+
+// Overrides is the table of DNS override rules ordered by priority.
+type Overrides struct {
+	hosts []*Override
+	cidrs []*Override
+}
+
+// newOverrides parses the override rules, along with the legacy replace IPs which have the
+// lowest priority, so that they only apply when no rule matches, and are ordered from the
+// most specific CIDR.
+func newOverrides(rules []OverrideConfig, replaceIPs map[string]string) (*Overrides, error) {
+	legacy := make([]OverrideConfig, 0, len(replaceIPs))
+	for cidr, ip := range replaceIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("parsing replace IP: %w", err)
+		}
+		legacy = append(legacy, OverrideConfig{Match: cidr, Addresses: []string{ip}, Priority: math.MinInt})
+	}
+	slices.SortFunc(legacy, func(a, b OverrideConfig) int {
+		_, x, _ := net.ParseCIDR(a.Match)
+		_, y, _ := net.ParseCIDR(b.Match)
+		onesX, _ := x.Mask.Size()
+		onesY, _ := y.Mask.Size()
+		return cmp.Or(cmp.Compare(onesY, onesX), strings.Compare(a.Match, b.Match))
+	})
+
+	o := &Overrides{}
+	for _, rule := range append(slices.Clone(rules), legacy...) {
+		override, err := parseOverride(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		if override.CIDR != nil {
+			o.cidrs = append(o.cidrs, override)
+		} else {
+			o.hosts = append(o.hosts, override)
+		}
+	}
+
+	byPriority := func(a, b *Override) int { return cmp.Compare(b.Priority, a.Priority) }
+	slices.SortStableFunc(o.hosts, byPriority)
+	slices.SortStableFunc(o.cidrs, byPriority)
+
+	return o, nil
+}
+
+// parseOverride parses an override rule
+func parseOverride(rule OverrideConfig) (*Override, error) {
+	if len(rule.Addresses) == 0 {
+		return nil, fmt.Errorf("override %s has no address", rule.Match)
+	}
+
+	override := &Override{
+		Priority: rule.Priority,
+		Users:    rule.Users,
+		Tags:     rule.Tags,
+	}
+
+	for _, address := range rule.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("override %s has an invalid address: %s", rule.Match, address)
+		}
+		override.Addresses = append(override.Addresses, ip)
+	}
+
+	if _, cidr, err := net.ParseCIDR(rule.Match); err == nil {
+		override.CIDR = cidr
+		return override, nil
+	}
+
+	host := normalizeHost(rule.Match)
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		override.Host = rest
+		override.Wildcard = true
+	} else {
+		override.Host = host
+	}
+
+	if override.Host == "" || strings.Contains(override.Host, "*") {
+		return nil, fmt.Errorf("override has an invalid match: %s", rule.Match)
+	}
+
+	return override, nil
+}
+
+// Lookup returns the addresses of the first hostname rule matching the hostname in the scope
+func (o *Overrides) Lookup(hostname string, scope OverrideScope) ([]net.IP, bool) {
+	hostname = normalizeHost(hostname)
+	for _, override := range o.hosts {
+		if override.matchesHost(hostname) && override.inScope(scope) {
+			return override.Addresses, true
+		}
+	}
+
+	return nil, false
+}
+
+// Replace returns the addresses of the first CIDR rule containing the address in the scope
+func (o *Overrides) Replace(ip net.IP, scope OverrideScope) ([]net.IP, bool) {
+	for _, override := range o.cidrs {
+		if override.CIDR.Contains(ip) && override.inScope(scope) {
+			return override.Addresses, true
+		}
+	}
+
+	return nil, false
+}
+
+// IsEmpty returns whether there is no rule
+func (o *Overrides) IsEmpty() bool {
+	return len(o.hosts) == 0 && len(o.cidrs) == 0
+}
+
+// matchesHost returns whether the hostname is the host, or a subdomain for wildcards
+func (o *Override) matchesHost(hostname string) bool {
+	if o.Wildcard {
+		return strings.HasSuffix(hostname, "."+o.Host)
+	}
+
+	return hostname == o.Host
+}
+
+// inScope returns whether the rule applies to the user and the tags of the request
+func (o *Override) inScope(scope OverrideScope) bool {
+	if len(o.Users) > 0 && !slices.Contains(o.Users, scope.User) {
+		return false
+	}
+
+	for key, value := range o.Tags {
+		if !strings.EqualFold(scope.Tags[key], value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeHost lowercases the hostname without its trailing dot
+func normalizeHost(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"net"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+const overridesConfig = `
+dns_overrides:
+  - match: "api.example.com"
+    addresses: ["2001:db8::1", "2001:db8::2"]
+  - match: "*.example.com"
+    addresses: ["2001:db8::10"]
+  - match: "*.example.com"
+    addresses: ["2001:db8::20"]
+    priority: 10
+    tags:
+      country: ch
+  - match: "api.example.com"
+    addresses: ["2001:db8::30"]
+    priority: 5
+    users: ["john"]
+  - match: "198.51.100.0/24"
+    addresses: ["2001:db8::40"]
+replace_ips:
+  "198.51.100.0/25": "2001:db8::50"
+  "198.51.100.0/26": "2001:db8::60"
+`
+
+func newTestOverrides(t *testing.T) *Overrides {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(overridesConfig), &cfg); err != nil {
+		t.Fatalf("yaml.Unmarshal() returned error: %v", err)
+	}
+
+	overrides, err := newOverrides(cfg.DNSOverrides, cfg.ReplaceIPs)
+	if err != nil {
+		t.Fatalf("newOverrides() returned error: %v", err)
+	}
+
+	return overrides
+}
+
+func TestOverridesLookup(t *testing.T) {
+	overrides := newTestOverrides(t)
+
+	tests := []struct {
+		hostname string
+		scope    OverrideScope
+		expected []string
+	}{
+		{"api.example.com", OverrideScope{}, []string{"2001:db8::1", "2001:db8::2"}},
+		{"API.example.com.", OverrideScope{}, []string{"2001:db8::1", "2001:db8::2"}},
+		{"api.example.com", OverrideScope{User: "john"}, []string{"2001:db8::30"}},
+		{"api.example.com", OverrideScope{User: "john", Tags: map[string]string{"country": "CH"}}, []string{"2001:db8::20"}},
+		{"www.example.com", OverrideScope{}, []string{"2001:db8::10"}},
+		{"a.b.example.com", OverrideScope{}, []string{"2001:db8::10"}},
+		{"example.com", OverrideScope{}, nil},
+		{"example.org", OverrideScope{}, nil},
+	}
+
+	for _, test := range tests {
+		ips, ok := overrides.Lookup(test.hostname, test.scope)
+		if ok != (test.expected != nil) || len(ips) != len(test.expected) {
+			t.Fatalf("Lookup(%s, %v) = %v, expected %v", test.hostname, test.scope, ips, test.expected)
+		}
+
+		for i, ip := range ips {
+			if !ip.Equal(net.ParseIP(test.expected[i])) {
+				t.Errorf("Lookup(%s, %v) = %v, expected %v", test.hostname, test.scope, ips, test.expected)
+			}
+		}
+	}
+}
+
+func TestOverridesReplace(t *testing.T) {
+	overrides := newTestOverrides(t)
+
+	// Rules come first, then the replace IPs from the most specific CIDR
+	tests := map[string]string{
+		"198.51.100.1":   "2001:db8::40",
+		"198.51.100.200": "2001:db8::40",
+		"192.0.2.1":      "",
+	}
+
+	for ip, expected := range tests {
+		ips, ok := overrides.Replace(net.ParseIP(ip), OverrideScope{})
+		if expected == "" {
+			if ok {
+				t.Errorf("Replace(%s) = %v, expected no override", ip, ips)
+			}
+			continue
+		}
+
+		if !ok || !ips[0].Equal(net.ParseIP(expected)) {
+			t.Errorf("Replace(%s) = %v, expected %s", ip, ips, expected)
+		}
+	}
+
+	legacy, err := newOverrides(nil, map[string]string{
+		"198.51.100.0/24": "2001:db8::50",
+		"198.51.100.0/26": "2001:db8::60",
+	})
+	if err != nil {
+		t.Fatalf("newOverrides() returned error: %v", err)
+	}
+
+	if ips, _ := legacy.Replace(net.ParseIP("198.51.100.1"), OverrideScope{}); !ips[0].Equal(net.ParseIP("2001:db8::60")) {
+		t.Errorf("Replace() = %v, expected the most specific replace IP", ips)
+	}
+
+	// Replace IPs only apply when no rule matches, whatever its priority
+	mixed, err := newOverrides([]OverrideConfig{
+		{Match: "198.51.100.0/24", Addresses: []string{"2001:db8::70"}, Priority: -10},
+	}, map[string]string{"198.51.100.0/26": "2001:db8::60"})
+	if err != nil {
+		t.Fatalf("newOverrides() returned error: %v", err)
+	}
+
+	if ips, _ := mixed.Replace(net.ParseIP("198.51.100.1"), OverrideScope{}); !ips[0].Equal(net.ParseIP("2001:db8::70")) {
+		t.Errorf("Replace() = %v, expected the rule of negative priority before the replace IPs", ips)
+	}
+}
+
+func TestOverridesInvalid(t *testing.T) {
+	rules := [][]OverrideConfig{
+		{{Match: "example.com"}},
+		{{Match: "example.com", Addresses: []string{"nope"}}},
+		{{Match: "*", Addresses: []string{"2001:db8::1"}}},
+		{{Match: "a.*.example.com", Addresses: []string{"2001:db8::1"}}},
+	}
+
+	for _, rule := range rules {
+		if _, err := newOverrides(rule, nil); err == nil {
+			t.Errorf("newOverrides(%v) returned no error", rule)
+		}
+	}
+
+	if _, err := newOverrides(nil, map[string]string{"nope": "2001:db8::1"}); err == nil {
+		t.Errorf("newOverrides() returned no error for an invalid replace IP")
+	}
+}
@@ -2,11 +2,16 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/goccy/go-yaml"
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/geo"
+	"github.com/vlourme/go-proxy/internal/resolver"
 	"github.com/vlourme/go-proxy/internal/utils"
 )
 
@@ -28,8 +33,18 @@ type Config struct {
 	DebugMode bool `yaml:"debug_mode"`
 	// TestPort is the port to test the proxy.
 	TestPort uint16 `yaml:"test_port"`
-	// MaxTimeout is the maximum timeout for a session.
+	// AdminAddress is the address of the admin endpoints (stats), disabled if empty.
+	AdminAddress string `yaml:"admin_address"`
+	// MaxTimeout is the maximum timeout of a session in minutes, and the default idle timeout in seconds.
 	MaxTimeout int `yaml:"max_timeout"`
+	// Timeouts are the timeouts of the relayed connections, which users can lower.
+	Timeouts struct {
+		// Idle is the time in seconds without traffic after which a connection is closed,
+		// defaults to max_timeout.
+		Idle int `yaml:"idle"`
+		// Lifetime is the maximum duration of a connection in seconds, zero is unlimited.
+		Lifetime int `yaml:"lifetime"`
+	} `yaml:"timeouts"`
 	// Auth is the authentication configuration.
 	Auth struct {
 		Type        AuthType `yaml:"type"`
@@ -39,6 +54,9 @@ type Config struct {
 		} `yaml:"credentials"`
 		Redis struct {
 			DSN string `yaml:"dsn"`
+			// LimitsPrefix is the prefix of the hash keys holding the limits of the users,
+			// e.g. "limits:" reads the limits of john from limits:john, disabled if empty.
+			LimitsPrefix string `yaml:"limits_prefix"`
 		} `yaml:"redis"`
 	} `yaml:"auth"`
 	// BindPrefixes is the list of prefixes to bind to.
@@ -49,105 +67,264 @@ type Config struct {
 	FallbackPrefixes []string `yaml:"fallback_prefixes"`
 	// LocatedPrefixes is the list of prefixes to bind to for each location.
 	LocatedPrefixes map[string][]string `yaml:"located_prefixes"`
-	// ReplaceIPs is the list of IPs to replace with the override.
+	// Pools is the list of named pools with tags and weighted prefixes.
+	Pools []PoolConfig `yaml:"pools"`
+	// Allocation is how addresses are picked from the pools made of BindPrefixes,
+	// FallbackPrefixes and LocatedPrefixes, keyed by pool name: "bind", "fallback"
+	// or a location.
+	Allocation map[string]Allocation `yaml:"allocation"`
+	// SubnetGranularity is the length of the subnet randomly picked inside a prefix
+	// before picking a host, per address family. Zero picks a host from the whole prefix.
+	SubnetGranularity struct {
+		IPv4 int `yaml:"ipv4"`
+		IPv6 int `yaml:"ipv6"`
+	} `yaml:"subnet_granularity"`
+	// GeoIP is the local database classifying the prefixes by location.
+	GeoIP struct {
+		// Database is the path to a MaxMind database (.mmdb) or a CSV range file (.csv).
+		Database string `yaml:"database"`
+		// Granularity is the length of the sub-prefixes classified separately,
+		// zero classifies each prefix as a whole.
+		Granularity int `yaml:"granularity"`
+	} `yaml:"geoip"`
+	// HappyEyeballs configures the racing of connections across the resolved addresses.
+	HappyEyeballs struct {
+		// AttemptDelay is the delay in milliseconds before starting the next attempt, defaults to 250.
+		AttemptDelay int `yaml:"attempt_delay"`
+		// FreshEgress is whether every attempt gets a new egress address instead of one per family.
+		FreshEgress bool `yaml:"fresh_egress"`
+	} `yaml:"happy_eyeballs"`
+	// DialRetry retries the failed connections to the target with new egress addresses.
+	DialRetry struct {
+		// Attempts is the maximum number of connection rounds, each racing the target addresses.
+		// Zero or one disables retries.
+		Attempts int `yaml:"attempts"`
+		// Timeout is the maximum total time of the rounds in seconds, zero is unlimited.
+		Timeout int `yaml:"timeout"`
+		// SwitchFamily is whether each retry starts with the other address family of the target.
+		SwitchFamily bool `yaml:"switch_family"`
+	} `yaml:"dial_retry"`
+	// PrefixHealth takes the prefixes failing to connect out of rotation.
+	PrefixHealth HealthConfig `yaml:"prefix_health"`
+	// DNS is the configuration of the upstream DNS servers.
+	DNS resolver.Config `yaml:"dns"`
+	// DNS64 synthesizes IPv6 addresses for IPv4-only targets, to reach them through a NAT64 gateway.
+	DNS64 struct {
+		// Prefix is the NAT64 prefix, e.g. 64:ff9b::/96, disabled if empty.
+		Prefix string `yaml:"prefix"`
+	} `yaml:"dns64"`
+	// DestinationGuard restricts the destination addresses which can be dialed.
+	DestinationGuard struct {
+		// Disable is whether every destination can be dialed.
+		Disable bool `yaml:"disable"`
+		// Deny is the list of CIDRs denied on top of the private and reserved ones and the pools.
+		Deny []string `yaml:"deny"`
+		// Allow is the list of CIDRs allowed even if denied.
+		Allow []string `yaml:"allow"`
+	} `yaml:"destination_guard"`
+	// DNSOverrides are the rules overriding the resolution of hostnames or resolved addresses.
+	DNSOverrides []OverrideConfig `yaml:"dns_overrides"`
+	// ReplaceIPs is the list of IPs to replace with the override, applied after the DNS overrides.
 	ReplaceIPs map[string]string `yaml:"replace_ips"`
+	// Accounting is the configuration of the traffic accounting.
+	Accounting struct {
+		// Sink is where the traffic is flushed: redis, jsonl, or empty to only count in memory.
+		Sink string `yaml:"sink"`
+		// Path is the file of the jsonl sink.
+		Path string `yaml:"path"`
+		// Prefix is the prefix of the hash keys of the redis sink, defaults to "usage:".
+		Prefix string `yaml:"prefix"`
+		// Interval is the flush interval in seconds, defaults to 10.
+		Interval int `yaml:"interval"`
+	} `yaml:"accounting"`
+	// Policies are the restrictions applied to the users.
+	Policies PoliciesConfig `yaml:"policies"`
+	// ProxyHeaders are the optional headers of the CONNECT responses.
+	ProxyHeaders struct {
+		// IP is whether to send the egress address in X-Proxy-IP.
+		IP bool `yaml:"ip"`
+		// Session is whether to send the session of the request in X-Proxy-Session.
+		Session bool `yaml:"session"`
+	} `yaml:"proxy_headers"`
+	// BanDetection marks the egress addresses banned by the targets of plain HTTP requests.
+	BanDetection BanConfig `yaml:"ban_detection"`
 	// DeletedHeaders is the list of headers to delete.
 	DeletedHeaders []string `yaml:"deleted_headers"`
 }
 
-var config *Config
-var bindPrefixes = []net.IPNet{}
-var fallbackPrefixes = []net.IPNet{}
-var locatedPrefixes = map[string][]net.IPNet{}
-var replaceIPs = map[*net.IPNet]string{}
+// state is the parsed config along with the values derived from it,
+// swapped as a whole on reload.
+type state struct {
+	config    *Config
+	pools     *Registry
+	resolver  *resolver.Resolver
+	dns64     *net.IPNet
+	overrides *Overrides
+	guard     *Guard
+	policies  *Policies
+	bans      *BanRules
+}
+
+var path = flag.String("config", "config.yaml", "The path to the config file")
+var current atomic.Pointer[state]
+var loadOnce sync.Once
 
-func load() *Config {
-	path := flag.String("config", "config.yaml", "The path to the config file")
+func load() {
 	flag.Parse()
 
+	s, err := parse(nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading config")
+	}
+
+	current.Store(s)
+	prefixHealthTracker.configure(s.config.PrefixHealth)
+}
+
+// parse reads the config file and derives the state from it. The pools unchanged since the
+// previous registry, if any, keep their allocator.
+func parse(previous *Registry) (*state, error) {
 	yamlFile, err := os.ReadFile(*path)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading config file")
+		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
 	var cfg Config
 	err = yaml.Unmarshal(yamlFile, &cfg)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error parsing config file")
+		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
 
-	for _, prefix := range cfg.BindPrefixes {
-		_, ipnet, err := net.ParseCIDR(prefix)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error parsing bind prefix")
-		}
-		bindPrefixes = append(bindPrefixes, *ipnet)
+	pools, err := newRegistry(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing pools: %w", err)
 	}
+	pools.adopt(previous)
 
-	for _, prefix := range cfg.FallbackPrefixes {
-		_, ipnet, err := net.ParseCIDR(prefix)
+	if cfg.GeoIP.Database != "" {
+		db, err := geo.Open(cfg.GeoIP.Database)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error parsing fallback prefix")
+			return nil, fmt.Errorf("opening GeoIP database: %w", err)
 		}
-		fallbackPrefixes = append(fallbackPrefixes, *ipnet)
+
+		pools.classify(db, cfg.GeoIP.Granularity)
+		db.Close()
 	}
 
-	for location, prefixes := range cfg.LocatedPrefixes {
-		for _, prefix := range prefixes {
-			_, ipnet, err := net.ParseCIDR(prefix)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Error parsing located prefix")
-			}
-			locatedPrefixes[location] = append(locatedPrefixes[location], *ipnet)
-		}
+	dns, err := resolver.New(cfg.DNS)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DNS upstreams: %w", err)
 	}
 
-	for cidr, ip := range cfg.ReplaceIPs {
-		_, ipnet, err := net.ParseCIDR(cidr)
+	var dns64 *net.IPNet
+	if cfg.DNS64.Prefix != "" {
+		_, dns64, err = net.ParseCIDR(cfg.DNS64.Prefix)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error parsing replace IP")
+			return nil, fmt.Errorf("parsing DNS64 prefix: %w", err)
+		}
+
+		if _, err := utils.EmbedIPv4(*dns64, net.IPv4zero); err != nil {
+			return nil, fmt.Errorf("DNS64 prefix must be an IPv6 /32, /40, /48, /56, /64 or /96: %w", err)
 		}
-		replaceIPs[ipnet] = ip
 	}
 
-	return &cfg
+	overrides, err := newOverrides(cfg.DNSOverrides, cfg.ReplaceIPs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DNS overrides: %w", err)
+	}
+
+	guard, err := newGuard(&cfg, pools, dns64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing destination guard: %w", err)
+	}
+
+	policies, err := newPolicies(cfg.Policies, dns64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing policies: %w", err)
+	}
+
+	bans, err := newBanRules(cfg.BanDetection)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ban detection: %w", err)
+	}
+
+	return &state{
+		config:    &cfg,
+		pools:     pools,
+		resolver:  dns,
+		dns64:     dns64,
+		overrides: overrides,
+		guard:     guard,
+		policies:  policies,
+		bans:      bans,
+	}, nil
+}
+
+// get returns the current state, loading it on first use
+func get() *state {
+	loadOnce.Do(load)
+	return current.Load()
 }
 
 // Get returns the parsed config
 func Get() *Config {
-	if config == nil {
-		config = load()
+	return get().config
+}
+
+// Reload re-reads the config file. The current config is kept if the new one is invalid.
+// Pools with the same name, prefixes and allocation options keep their allocation state,
+// the other ones are created again.
+func Reload() error {
+	s, err := parse(get().pools)
+	if err != nil {
+		return err
 	}
 
-	return config
+	current.Store(s)
+	prefixHealthTracker.configure(s.config.PrefixHealth)
+	return nil
+}
+
+// GetPools returns the pool registry
+func GetPools() *Registry {
+	return get().pools
 }
 
-// GetBindPrefixes returns the bind prefixes
-func GetBindPrefixes() []net.IPNet {
-	return bindPrefixes
+// GetResolver returns the resolver of the configured DNS upstreams
+func GetResolver() *resolver.Resolver {
+	return get().resolver
 }
 
-// GetAnyBindPrefix returns a random bind prefix
-func GetAnyBindPrefix() net.IPNet {
-	return bindPrefixes[utils.RandomInt(len(bindPrefixes))]
+// GetDNS64 returns the NAT64 prefix of synthesized addresses, nil if disabled
+func GetDNS64() *net.IPNet {
+	return get().dns64
 }
 
-// GetFallbackPrefixes returns the fallback prefixes
-func GetFallbackPrefixes() []net.IPNet {
-	return fallbackPrefixes
+// GetGuard returns the guard of the destination addresses
+func GetGuard() *Guard {
+	return get().guard
 }
 
-// GetAnyFallbackPrefix returns a random fallback prefix
-func GetAnyFallbackPrefix() net.IPNet {
-	return fallbackPrefixes[utils.RandomInt(len(fallbackPrefixes))]
+// GetPolicies returns the policies of the users
+func GetPolicies() *Policies {
+	return get().policies
 }
 
-// GetLocatedPrefixes returns the located prefixes
-func GetLocatedPrefixes() map[string][]net.IPNet {
-	return locatedPrefixes
+// GetBanRules returns the rules detecting the egress addresses banned by the targets
+func GetBanRules() *BanRules {
+	return get().bans
+}
+
+// GetGranularity returns the subnet granularity for the family of the prefix
+func (c *Config) GetGranularity(prefix net.IPNet) int {
+	if _, bits := prefix.Mask.Size(); bits == 32 {
+		return c.SubnetGranularity.IPv4
+	}
+
+	return c.SubnetGranularity.IPv6
 }
 
-// GetReplaceIPs returns the replace IPs
-func GetReplaceIPs() map[*net.IPNet]string {
-	return replaceIPs
+// GetOverrides returns the DNS override rules, including the replace IPs
+func GetOverrides() *Overrides {
+	return get().overrides
 }
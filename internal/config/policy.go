@@ -0,0 +1,304 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrACLDenied = errors.New("destination denied by ACL")
+
+const (
+	ActionAllow string = "allow"
+	ActionDeny  string = "deny"
+)
+
+// PoliciesConfig is the configuration of the policies applied to the users.
+type PoliciesConfig struct {
+	// Default is the policy of every user, applied after their own.
+	Default PolicyConfig `yaml:"default"`
+	// Users are the policies of the users, keyed by username.
+	Users map[string]PolicyConfig `yaml:"users"`
+}
+
+// PolicyConfig is the configuration of the restrictions applied to a user.
+type PolicyConfig struct {
+	// ACL is the list of destination rules, the first matching rule applies.
+	ACL []ACLRuleConfig `yaml:"acl"`
+	// Limits are the limits of the user, unset ones are taken from the default policy.
+	Limits Limits `yaml:"limits"`
+	// Pools are the names of the pools the user may select and pin addresses of, including the
+	// pools derived from them. Taken from the default policy when unset, every pool if empty.
+	Pools []string `yaml:"pools"`
+}
+
+// Limits are the limits applied to a user, zero is unlimited. When overriding limits, zero
+// keeps the limit and -1 lifts it. The redis tags are the fields of the user record overriding them.
+type Limits struct {
+	// Upload is the bandwidth from the user to the targets in KiB/s, across their connections.
+	Upload int `yaml:"upload" redis:"upload"`
+	// Download is the bandwidth from the targets to the user in KiB/s, across their connections.
+	Download int `yaml:"download" redis:"download"`
+	// ConnectionUpload is the upload bandwidth of each connection in KiB/s.
+	ConnectionUpload int `yaml:"connection_upload" redis:"connection_upload"`
+	// ConnectionDownload is the download bandwidth of each connection in KiB/s.
+	ConnectionDownload int `yaml:"connection_download" redis:"connection_download"`
+	// MaxConnections is the number of concurrent connections.
+	MaxConnections int `yaml:"max_connections" redis:"max_connections"`
+	// RequestsPerSecond is the number of requests per second.
+	RequestsPerSecond int `yaml:"requests_per_second" redis:"requests_per_second"`
+	// Quota is the traffic allowed in MiB, uploaded and downloaded.
+	Quota int `yaml:"quota" redis:"quota"`
+}
+
+// ACLRuleConfig is the configuration of a destination rule. Every criterion set must match.
+type ACLRuleConfig struct {
+	// Name identifies the rule in the logs, defaults to its position.
+	Name string `yaml:"name"`
+	// Action is allow or deny.
+	Action string `yaml:"action"`
+	// Hosts are hostnames, wildcard domains (*.example.com, matching example.com too) or * for any.
+	Hosts []string `yaml:"hosts"`
+	// CIDRs are networks of the resolved addresses.
+	CIDRs []string `yaml:"cidrs"`
+	// Ports are ports or port ranges, e.g. 25 or 8000-9000.
+	Ports []string `yaml:"ports"`
+}
+
+// ACLRule is a parsed destination rule.
+type ACLRule struct {
+	Name  string
+	Allow bool
+	Hosts []string
+	CIDRs []*net.IPNet
+	Ports [][2]int
+}
+
+// Policy is a parsed policy.
+type Policy struct {
+	ACL    []*ACLRule
+	Limits Limits
+	Pools  []string
+}
+
+// Policies are the policies of the users along with the default one.
+type Policies struct {
+	defaults *Policy
+	users    map[string]*Policy
+	dns64    *net.IPNet
+}
+
+// newPolicies parses the policies. The IPv4 addresses embedded into the DNS64 prefix, if
+// any, are matched by the CIDRs of the rules as well as the IPv6 addresses embedding them.
+func newPolicies(cfg PoliciesConfig, dns64 *net.IPNet) (*Policies, error) {
+	defaults, err := newPolicy("default", cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policies{defaults: defaults, users: map[string]*Policy{}, dns64: dns64}
+	for user, policyCfg := range cfg.Users {
+		policy, err := newPolicy(user, policyCfg)
+		if err != nil {
+			return nil, err
+		}
+		p.users[user] = policy
+	}
+
+	return p, nil
+}
+
+// newPolicy parses the policy of the owner, a user or the default policy
+func newPolicy(owner string, cfg PolicyConfig) (*Policy, error) {
+	policy := &Policy{Limits: cfg.Limits, Pools: cfg.Pools}
+	for i, ruleCfg := range cfg.ACL {
+		rule, err := parseACLRule(ruleCfg)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s, ACL rule %d: %w", owner, i+1, err)
+		}
+
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s#%d", owner, i+1)
+		}
+		policy.ACL = append(policy.ACL, rule)
+	}
+
+	return policy, nil
+}
+
+// parseACLRule parses a destination rule
+func parseACLRule(cfg ACLRuleConfig) (*ACLRule, error) {
+	rule := &ACLRule{Name: cfg.Name}
+
+	switch strings.ToLower(cfg.Action) {
+	case ActionAllow:
+		rule.Allow = true
+	case ActionDeny:
+	default:
+		return nil, fmt.Errorf("invalid action: %s", cfg.Action)
+	}
+
+	for _, host := range cfg.Hosts {
+		pattern, err := parseHostPattern(host)
+		if err != nil {
+			return nil, err
+		}
+		rule.Hosts = append(rule.Hosts, pattern)
+	}
+
+	for _, cidr := range cfg.CIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rule.CIDRs = append(rule.CIDRs, ipnet)
+	}
+
+	for _, port := range cfg.Ports {
+		from, to, found := strings.Cut(port, "-")
+		if !found {
+			to = from
+		}
+
+		start, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", port)
+		}
+		end, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid port: %s", port)
+		}
+
+		rule.Ports = append(rule.Ports, [2]int{int(start), int(end)})
+	}
+
+	return rule, nil
+}
+
+// parseHostPattern parses a hostname, a wildcard domain or *. Wildcards are only allowed
+// as the first label.
+func parseHostPattern(host string) (string, error) {
+	if host == "*" {
+		return host, nil
+	}
+
+	domain, wildcard := strings.CutPrefix(host, "*.")
+	domain = normalizeHost(domain)
+	if domain == "" || strings.Contains(domain, "*") {
+		return "", fmt.Errorf("invalid host: %s", host)
+	}
+
+	if wildcard {
+		return "*." + domain, nil
+	}
+
+	return domain, nil
+}
+
+// Limits returns the limits of the user, taken from the default policy when unset
+func (p *Policies) Limits(user string) Limits {
+	limits := Limits{}.Merge(p.defaults.Limits)
+	if policy, ok := p.users[user]; ok {
+		limits = limits.Merge(policy.Limits)
+	}
+
+	return limits
+}
+
+// Pools returns the names of the pools the user may use, taken from the default policy when
+// unset, empty for every pool
+func (p *Policies) Pools(user string) []string {
+	if policy, ok := p.users[user]; ok && len(policy.Pools) > 0 {
+		return policy.Pools
+	}
+
+	return p.defaults.Pools
+}
+
+// Merge returns the limits overridden by the ones set in other, negative ones being unlimited
+func (l Limits) Merge(other Limits) Limits {
+	override := func(value *int, with int) {
+		if with != 0 {
+			*value = max(with, 0)
+		}
+	}
+
+	override(&l.Upload, other.Upload)
+	override(&l.Download, other.Download)
+	override(&l.ConnectionUpload, other.ConnectionUpload)
+	override(&l.ConnectionDownload, other.ConnectionDownload)
+	override(&l.MaxConnections, other.MaxConnections)
+	override(&l.RequestsPerSecond, other.RequestsPerSecond)
+	override(&l.Quota, other.Quota)
+
+	return l
+}
+
+// CheckDestination returns whether the user may connect to the destination, along with
+// the rule which decided, nil if none matched. The rules of the user come first, then the
+// default ones. Destinations matching no rule are allowed.
+func (p *Policies) CheckDestination(user, host string, ip net.IP, port int) (bool, *ACLRule) {
+	host = normalizeHost(host)
+	embedded := embeddedIPv4(ip, p.dns64)
+	for _, policy := range []*Policy{p.users[user], p.defaults} {
+		if policy == nil {
+			continue
+		}
+
+		for _, rule := range policy.ACL {
+			if rule.Matches(host, ip, embedded, port) {
+				return rule.Allow, rule
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Matches returns whether the destination matches every criterion of the rule. The CIDRs
+// match the address or the IPv4 address it embeds, nil if none.
+func (r *ACLRule) Matches(host string, ip, embedded net.IP, port int) bool {
+	if len(r.Hosts) > 0 && !matchesAny(r.Hosts, func(pattern string) bool { return matchHostPattern(pattern, host) }) {
+		return false
+	}
+
+	if len(r.CIDRs) > 0 && !matchesAny(r.CIDRs, func(cidr *net.IPNet) bool {
+		return cidr.Contains(ip) || (embedded != nil && cidr.Contains(embedded))
+	}) {
+		return false
+	}
+
+	if len(r.Ports) > 0 && !matchesAny(r.Ports, func(ports [2]int) bool { return port >= ports[0] && port <= ports[1] }) {
+		return false
+	}
+
+	return true
+}
+
+// matchesAny returns whether any of the values matches
+func matchesAny[T any](values []T, match func(T) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchHostPattern returns whether the hostname matches the pattern: a hostname,
+// a wildcard domain (*.example.com) matching the domain and its subdomains, or * matching
+// any hostname
+func matchHostPattern(pattern, hostname string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return hostname == suffix || strings.HasSuffix(hostname, "."+suffix)
+	}
+
+	return hostname == pattern
+}
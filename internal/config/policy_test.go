@@ -0,0 +1,145 @@
+package config
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+const policiesConfig = `
+policies:
+  default:
+    acl:
+      - name: no-smtp
+        action: deny
+        ports: [25, 465, 587]
+      - action: deny
+        cidrs: ["198.51.100.0/24"]
+  users:
+    john:
+      acl:
+        - name: john-internal
+          action: allow
+          hosts: ["*.internal.example.com"]
+          ports: ["8000-9000"]
+        - name: john-blocked
+          action: deny
+          hosts: ["blocked.example.com", "*.blocked.example.com"]
+`
+
+func TestPoliciesCheckDestination(t *testing.T) {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(policiesConfig), &cfg); err != nil {
+		t.Fatalf("yaml.Unmarshal() returned error: %v", err)
+	}
+
+	_, dns64, _ := net.ParseCIDR("2001:db8:64::/96")
+	policies, err := newPolicies(cfg.Policies, dns64)
+	if err != nil {
+		t.Fatalf("newPolicies() returned error: %v", err)
+	}
+
+	tests := []struct {
+		user    string
+		host    string
+		ip      string
+		port    int
+		allowed bool
+		rule    string
+	}{
+		{"jane", "example.com", "192.0.2.1", 443, true, ""},
+		{"jane", "mail.example.com", "192.0.2.1", 25, false, "no-smtp"},
+		{"jane", "example.org", "198.51.100.7", 443, false, "default#2"},
+		{"jane", "example.org", "64:ff9b::c633:6407", 443, false, "default#2"},
+		{"jane", "example.org", "2001:db8:64::c633:6407", 443, false, "default#2"},
+		{"jane", "example.org", "2001:db8:65::c633:6407", 443, true, ""},
+		{"john", "api.internal.example.com", "198.51.100.7", 8080, true, "john-internal"},
+		{"john", "api.internal.example.com", "198.51.100.7", 443, false, "default#2"},
+		{"john", "internal.example.com", "192.0.2.1", 8080, true, "john-internal"},
+		{"john", "notinternal.example.com", "192.0.2.1", 8080, true, ""},
+		{"john", "blocked.example.com.evil.test", "192.0.2.1", 443, true, ""},
+		{"john", "Blocked.Example.com.", "192.0.2.1", 443, false, "john-blocked"},
+		{"john", "www.blocked.example.com", "192.0.2.1", 443, false, "john-blocked"},
+		{"john", "example.com", "192.0.2.1", 587, false, "no-smtp"},
+	}
+
+	for _, test := range tests {
+		allowed, rule := policies.CheckDestination(test.user, test.host, net.ParseIP(test.ip), test.port)
+		if allowed != test.allowed {
+			t.Errorf("CheckDestination(%s, %s, %s, %d) = %v, expected %v", test.user, test.host, test.ip, test.port, allowed, test.allowed)
+		}
+
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != test.rule {
+			t.Errorf("CheckDestination(%s, %s, %s, %d) matched rule %q, expected %q", test.user, test.host, test.ip, test.port, name, test.rule)
+		}
+	}
+}
+
+func TestPoliciesInvalid(t *testing.T) {
+	rules := []ACLRuleConfig{
+		{Action: "reject"},
+		{Action: "deny", CIDRs: []string{"nope"}},
+		{Action: "deny", Ports: []string{"70000"}},
+		{Action: "deny", Ports: []string{"9000-8000"}},
+		{Action: "deny", Ports: []string{"http"}},
+		{Action: "deny", Hosts: []string{"*example.com"}},
+		{Action: "deny", Hosts: []string{"api.*.example.com"}},
+		{Action: "deny", Hosts: []string{"*."}},
+	}
+
+	for _, rule := range rules {
+		cfg := PoliciesConfig{Default: PolicyConfig{ACL: []ACLRuleConfig{rule}}}
+		if _, err := newPolicies(cfg, nil); err == nil {
+			t.Errorf("newPolicies(%+v) returned no error", rule)
+		}
+	}
+}
+
+func TestPoliciesLimits(t *testing.T) {
+	policies, err := newPolicies(PoliciesConfig{
+		Default: PolicyConfig{Limits: Limits{Upload: 100, Download: 1000, MaxConnections: 10, Quota: 1024}},
+		Users: map[string]PolicyConfig{
+			"john": {Limits: Limits{Download: 5000, ConnectionDownload: 500, MaxConnections: -1}},
+			"jack": {Limits: Limits{Upload: -1, Download: -1, MaxConnections: -1, Quota: -1}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("newPolicies() returned error: %v", err)
+	}
+
+	if limits := policies.Limits("jane"); limits != (Limits{Upload: 100, Download: 1000, MaxConnections: 10, Quota: 1024}) {
+		t.Errorf("Limits(jane) = %+v, expected the default limits", limits)
+	}
+
+	expected := Limits{Upload: 100, Download: 5000, ConnectionDownload: 500, Quota: 1024}
+	if limits := policies.Limits("john"); limits != expected {
+		t.Errorf("Limits(john) = %+v, expected %+v", limits, expected)
+	}
+
+	if limits := policies.Limits("jack"); limits != (Limits{}) {
+		t.Errorf("Limits(jack) = %+v, expected no limits", limits)
+	}
+}
+
+func TestPoliciesPools(t *testing.T) {
+	policies, err := newPolicies(PoliciesConfig{
+		Default: PolicyConfig{Pools: []string{"bind"}},
+		Users:   map[string]PolicyConfig{"john": {Pools: []string{"premium"}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("newPolicies() returned error: %v", err)
+	}
+
+	if pools := policies.Pools("jane"); !slices.Equal(pools, []string{"bind"}) {
+		t.Errorf("Pools(jane) = %v, expected the default pools", pools)
+	}
+	if pools := policies.Pools("john"); !slices.Equal(pools, []string{"premium"}) {
+		t.Errorf("Pools(john) = %v, expected [premium]", pools)
+	}
+}
@@ -0,0 +1,453 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/alloc"
+	"github.com/vlourme/go-proxy/internal/utils"
+)
+
+var (
+	ErrEmptyPool      = errors.New("pool has no prefix")
+	ErrNoFamilyPrefix = errors.New("no prefix of the requested address family")
+	ErrIPNotAllowed   = errors.New("pinned IP is not in a prefix allowed for the user")
+	ErrNoMatchingPool = errors.New("no pool matches the selection")
+)
+
+// Family is the address family requested by the user.
+type Family int
+
+const (
+	FamilyAny  Family = 0
+	FamilyIPv4 Family = 4
+	FamilyIPv6 Family = 6
+)
+
+// Matches returns whether the address is of the family
+func (f Family) Matches(ip net.IP) bool {
+	switch f {
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// Allocation is how addresses are picked from a prefix pool.
+type Allocation struct {
+	// Strategy is the allocation strategy: random, sequential or lru.
+	Strategy string `yaml:"strategy"`
+	// Exclusive guarantees that no two live sessions or connections share an address.
+	Exclusive bool `yaml:"exclusive"`
+	// Cooldown is the number of minutes before a used address can be handed out again.
+	Cooldown int `yaml:"cooldown"`
+}
+
+// PoolConfig is the configuration of a named pool.
+type PoolConfig struct {
+	// Name is the name of the pool, selected with the pool parameter.
+	Name string `yaml:"name"`
+	// Tags are arbitrary key-value pairs, selected with parameters named after the key.
+	Tags map[string]string `yaml:"tags"`
+	// Default is whether the pool serves requests which do not select any pool.
+	Default bool `yaml:"default"`
+	// Fallback is whether the pool serves targets not matching the family of the selected address.
+	Fallback bool `yaml:"fallback"`
+	// Prefixes is the list of prefixes of the pool.
+	Prefixes []PrefixConfig `yaml:"prefixes"`
+	// Allocation is how addresses are picked from the pool.
+	Allocation `yaml:",inline"`
+}
+
+// PrefixConfig is a prefix of a pool, either a CIDR or a CIDR with a weight.
+type PrefixConfig struct {
+	// CIDR is the prefix.
+	CIDR string `yaml:"cidr"`
+	// Weight is the relative probability of the prefix to be picked, defaults to 1.
+	Weight int `yaml:"weight"`
+}
+
+// UnmarshalYAML accepts a plain CIDR string as well as a prefix object
+func (p *PrefixConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&p.CIDR); err == nil {
+		return nil
+	}
+
+	type raw PrefixConfig
+	return unmarshal((*raw)(p))
+}
+
+// Pool is a named set of weighted prefixes sharing an allocator.
+// Derived pools are made of sub-prefixes of their parent pool.
+type Pool struct {
+	Name      string
+	Tags      map[string]string
+	Default   bool
+	Fallback  bool
+	Derived   bool
+	Parent    string
+	Prefixes  []net.IPNet
+	Weights   []int
+	Allocator *alloc.Allocator
+
+	allocation Allocation
+}
+
+// newPool parses the prefixes and creates the allocator of a pool
+func newPool(cfg PoolConfig) (*Pool, error) {
+	allocator, err := alloc.New(alloc.Options{
+		Strategy:  cfg.Strategy,
+		Exclusive: cfg.Exclusive,
+		Cooldown:  time.Duration(cfg.Cooldown) * time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &Pool{
+		Name:       cfg.Name,
+		Tags:       cfg.Tags,
+		Default:    cfg.Default,
+		Fallback:   cfg.Fallback,
+		Allocator:  allocator,
+		allocation: cfg.Allocation,
+	}
+	for _, prefix := range cfg.Prefixes {
+		_, ipnet, err := net.ParseCIDR(prefix.CIDR)
+		if err != nil {
+			return nil, err
+		}
+
+		weight := prefix.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		pool.Prefixes = append(pool.Prefixes, *ipnet)
+		pool.Weights = append(pool.Weights, weight)
+	}
+
+	return pool, nil
+}
+
+// Selector selects pools by name and tags.
+type Selector struct {
+	// Pool is the name of the pool, empty for any.
+	Pool string
+	// Tags are the tags the pool must carry.
+	Tags map[string]string
+}
+
+// IsEmpty returns whether the selector selects nothing in particular
+func (s Selector) IsEmpty() bool {
+	return s.Pool == "" && len(s.Tags) == 0
+}
+
+// Matches returns whether the pool matches the selector.
+// Fallback pools are only matched by name.
+func (s Selector) Matches(pool *Pool) bool {
+	if s.Pool != "" && !strings.EqualFold(s.Pool, pool.Name) {
+		return false
+	}
+
+	if s.Pool == "" && pool.Fallback {
+		return false
+	}
+
+	for key, value := range s.Tags {
+		if !strings.EqualFold(pool.Tags[key], value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Registry holds the prefix pools.
+type Registry struct {
+	pools []*Pool
+	// tags are the tag keys carried by any pool, the only ones selecting pools
+	tags map[string]struct{}
+}
+
+// newRegistry creates the pools of the config, including pools
+// for the bind_prefixes, fallback_prefixes and located_prefixes settings:
+//
+//   - bind_prefixes is the default "bind" pool.
+//   - fallback_prefixes is the "fallback" pool.
+//   - each location of located_prefixes is a pool named after the location with a country tag.
+func newRegistry(cfg *Config) (*Registry, error) {
+	configs := []PoolConfig{}
+	legacy := func(name string, cidrs []string) PoolConfig {
+		pool := PoolConfig{Name: name, Allocation: cfg.Allocation[name]}
+		for _, cidr := range cidrs {
+			pool.Prefixes = append(pool.Prefixes, PrefixConfig{CIDR: cidr})
+		}
+		return pool
+	}
+
+	if len(cfg.BindPrefixes) > 0 {
+		pool := legacy("bind", cfg.BindPrefixes)
+		pool.Default = true
+		configs = append(configs, pool)
+	}
+
+	if len(cfg.FallbackPrefixes) > 0 {
+		pool := legacy("fallback", cfg.FallbackPrefixes)
+		pool.Fallback = true
+		configs = append(configs, pool)
+	}
+
+	locations := slices.Sorted(maps.Keys(cfg.LocatedPrefixes))
+	for _, location := range locations {
+		pool := legacy(location, cfg.LocatedPrefixes[location])
+		pool.Tags = map[string]string{"country": location}
+		configs = append(configs, pool)
+	}
+
+	configs = append(configs, cfg.Pools...)
+
+	registry := &Registry{}
+	names := make(map[string]struct{})
+	for _, poolCfg := range configs {
+		if _, ok := names[poolCfg.Name]; ok || poolCfg.Name == "" {
+			return nil, fmt.Errorf("pool name is empty or duplicated: %q", poolCfg.Name)
+		}
+		names[poolCfg.Name] = struct{}{}
+
+		pool, err := newPool(poolCfg)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolCfg.Name, err)
+		}
+		registry.pools = append(registry.pools, pool)
+	}
+
+	registry.indexTags()
+	return registry, nil
+}
+
+// indexTags records the tag keys carried by the pools
+func (r *Registry) indexTags() {
+	r.tags = make(map[string]struct{})
+	for _, pool := range r.pools {
+		for key := range pool.Tags {
+			r.tags[strings.ToLower(key)] = struct{}{}
+		}
+	}
+}
+
+// adopt takes over the allocators of the pools of the previous registry with the same name,
+// prefixes and allocation options, so that their leases and cool-downs survive reloads.
+// It must be called before the pools are classified.
+func (r *Registry) adopt(previous *Registry) {
+	if previous == nil {
+		return
+	}
+
+	for _, pool := range r.pools {
+		for _, old := range previous.pools {
+			if !old.Derived && old.Name == pool.Name && old.allocation == pool.allocation &&
+				slices.EqualFunc(old.Prefixes, pool.Prefixes, func(a, b net.IPNet) bool { return a.String() == b.String() }) {
+				pool.Allocator = old.Allocator
+				break
+			}
+		}
+	}
+}
+
+// Pools returns every pool
+func (r *Registry) Pools() []*Pool {
+	return r.pools
+}
+
+// Prefixes returns the prefixes of every pool
+func (r *Registry) Prefixes() []net.IPNet {
+	prefixes := []net.IPNet{}
+	for _, pool := range r.pools {
+		prefixes = append(prefixes, pool.Prefixes...)
+	}
+
+	return prefixes
+}
+
+// Select returns the pools matching the selector.
+//
+//   - Tags no pool carries are ignored, they are parameters of something else.
+//   - If the selector is empty, the default pools are returned.
+//   - If no pool is marked as default, every pool but the fallback ones is a default pool.
+//   - If the selector matches no pool, ErrNoMatchingPool is returned.
+func (r *Registry) Select(selector Selector) ([]*Pool, error) {
+	tags := make(map[string]string, len(selector.Tags))
+	for key, value := range selector.Tags {
+		if _, ok := r.tags[strings.ToLower(key)]; ok {
+			tags[key] = value
+		}
+	}
+	selector.Tags = tags
+
+	if !selector.IsEmpty() {
+		matches := []*Pool{}
+		for _, pool := range r.pools {
+			if selector.Matches(pool) {
+				matches = append(matches, pool)
+			}
+		}
+
+		if len(matches) == 0 {
+			return nil, ErrNoMatchingPool
+		}
+		return matches, nil
+	}
+
+	defaults := []*Pool{}
+	for _, pool := range r.pools {
+		if pool.Default {
+			defaults = append(defaults, pool)
+		}
+	}
+
+	if len(defaults) > 0 {
+		return defaults, nil
+	}
+
+	for _, pool := range r.pools {
+		if !pool.Fallback {
+			defaults = append(defaults, pool)
+		}
+	}
+
+	return defaults, nil
+}
+
+// Entitled returns the registry of the named pools, along with the pools derived from them
+// and the fallback pools. Every pool is entitled if no name is given.
+func (r *Registry) Entitled(names []string) *Registry {
+	if len(names) == 0 {
+		return r
+	}
+
+	entitled := &Registry{tags: r.tags}
+	for _, pool := range r.pools {
+		named := func(name string) bool {
+			return strings.EqualFold(name, pool.Name) || (pool.Derived && strings.EqualFold(name, pool.Parent))
+		}
+		if pool.Fallback || slices.ContainsFunc(names, named) {
+			entitled.pools = append(entitled.pools, pool)
+		}
+	}
+
+	return entitled
+}
+
+// Allows returns whether the IP is inside a prefix of the pools
+func (r *Registry) Allows(ip net.IP) bool {
+	for _, pool := range r.pools {
+		for _, prefix := range pool.Prefixes {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Fallback returns the fallback pools
+func (r *Registry) Fallback() []*Pool {
+	pools := []*Pool{}
+	for _, pool := range r.pools {
+		if pool.Fallback {
+			pools = append(pools, pool)
+		}
+	}
+
+	return pools
+}
+
+// PrefixesOf returns every prefix of the pools containing the IP, including the derived ones
+func (r *Registry) PrefixesOf(ip net.IP) []net.IPNet {
+	prefixes := []net.IPNet{}
+	seen := make(map[string]struct{})
+	for _, pool := range r.pools {
+		for _, prefix := range pool.Prefixes {
+			if _, ok := seen[prefix.String()]; ok || !prefix.Contains(ip) {
+				continue
+			}
+			seen[prefix.String()] = struct{}{}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return prefixes
+}
+
+// PickPrefix returns a prefix of the family from the pools according to the prefix weights,
+// along with the pool it belongs to. ErrNoFamilyPrefix is returned if the pools have
+// prefixes, but none of the family.
+//
+// Unhealthy prefixes are out of rotation, unless every prefix of the family is unhealthy.
+func PickPrefix(pools []*Pool, family Family) (*Pool, net.IPNet, error) {
+	return pickPrefix(pools, family, prefixHealthTracker)
+}
+
+// pickPrefix picks a prefix of the family, avoiding the prefixes out of rotation in the tracker
+func pickPrefix(pools []*Pool, family Family, health *HealthTracker) (*Pool, net.IPNet, error) {
+	type candidate struct {
+		pool      *Pool
+		prefix    net.IPNet
+		weight    int
+		available bool
+	}
+
+	var candidates []candidate
+	total, available, count := 0, 0, 0
+	for _, pool := range pools {
+		for i, weight := range pool.Weights {
+			count++
+			if !family.Matches(pool.Prefixes[i].IP) {
+				continue
+			}
+
+			c := candidate{pool, pool.Prefixes[i], weight, health.Available(pool.Prefixes[i])}
+			candidates = append(candidates, c)
+			total += weight
+			if c.available {
+				available += weight
+			}
+		}
+	}
+
+	if total == 0 {
+		if count > 0 && family != FamilyAny {
+			return nil, net.IPNet{}, ErrNoFamilyPrefix
+		}
+		return nil, net.IPNet{}, ErrEmptyPool
+	}
+
+	// Better a likely failure than none at all
+	if available > 0 {
+		total = available
+	}
+
+	n := int(utils.RandomInt(total))
+	for _, c := range candidates {
+		if available > 0 && !c.available {
+			continue
+		}
+		if n < c.weight {
+			health.Picked(c.prefix)
+			return c.pool, c.prefix, nil
+		}
+		n -= c.weight
+	}
+
+	return nil, net.IPNet{}, ErrEmptyPool
+}
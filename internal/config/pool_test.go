@@ -0,0 +1,229 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/vlourme/go-proxy/internal/geo"
+)
+
+const poolsConfig = `
+bind_prefixes:
+  - "2001:db8:1::/48"
+fallback_prefixes:
+  - "192.0.2.0/24"
+located_prefixes:
+  ch:
+    - "2001:db8:2::/48"
+pools:
+  - name: premium
+    tags:
+      country: ch
+      city: zurich
+    prefixes:
+      - "2001:db8:3::/48"
+      - cidr: "2001:db8:4::/48"
+        weight: 3
+`
+
+func newTestRegistry(t *testing.T) *Registry {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(poolsConfig), &cfg); err != nil {
+		t.Fatalf("yaml.Unmarshal() returned error: %v", err)
+	}
+
+	registry, err := newRegistry(&cfg)
+	if err != nil {
+		t.Fatalf("newRegistry() returned error: %v", err)
+	}
+
+	return registry
+}
+
+func TestRegistrySelect(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	tests := []struct {
+		selector Selector
+		expected []string
+	}{
+		{Selector{}, []string{"bind"}},
+		{Selector{Tags: map[string]string{"country": "ch"}}, []string{"ch", "premium"}},
+		{Selector{Tags: map[string]string{"city": "Zurich"}}, []string{"premium"}},
+		{Selector{Pool: "premium"}, []string{"premium"}},
+		{Selector{Pool: "fallback"}, []string{"fallback"}},
+		{Selector{Tags: map[string]string{"foo": "bar"}}, []string{"bind"}},
+		{Selector{Pool: "premium", Tags: map[string]string{"foo": "bar"}}, []string{"premium"}},
+	}
+
+	for _, test := range tests {
+		pools := mustSelect(t, registry, test.selector)
+		if len(pools) != len(test.expected) {
+			t.Fatalf("Select(%v) returned %d pools, expected %v", test.selector, len(pools), test.expected)
+		}
+
+		for i, pool := range pools {
+			if pool.Name != test.expected[i] {
+				t.Errorf("Select(%v) returned %s, expected %s", test.selector, pool.Name, test.expected[i])
+			}
+		}
+	}
+
+	if fallback := registry.Fallback(); len(fallback) != 1 || fallback[0].Name != "fallback" {
+		t.Errorf("Fallback() returned %v, expected the fallback pool", fallback)
+	}
+
+	// Selections matching nothing don't fall back to the default pools
+	for _, selector := range []Selector{{Pool: "nope"}, {Tags: map[string]string{"country": "xx"}}} {
+		if _, err := registry.Select(selector); !errors.Is(err, ErrNoMatchingPool) {
+			t.Errorf("Select(%v) returned %v, expected ErrNoMatchingPool", selector, err)
+		}
+	}
+	if _, err := registry.Entitled([]string{"bind"}).Select(Selector{Pool: "premium"}); !errors.Is(err, ErrNoMatchingPool) {
+		t.Errorf("Select() returned %v for a pool the user is not entitled to, expected ErrNoMatchingPool", err)
+	}
+}
+
+// mustSelect returns the pools matching the selector
+func mustSelect(t *testing.T, registry *Registry, selector Selector) []*Pool {
+	t.Helper()
+
+	pools, err := registry.Select(selector)
+	if err != nil {
+		t.Fatalf("Select(%v) returned error: %v", selector, err)
+	}
+
+	return pools
+}
+
+func TestRegistryAllows(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	tests := []struct {
+		ip      string
+		pools   []string
+		allowed bool
+	}{
+		{"2001:db8:1::1", nil, true},
+		{"2001:db8:3::1", nil, true},
+		{"2001:db8:5::1", nil, false},
+		{"2001:db8:1::1", []string{"bind"}, true},
+		{"192.0.2.1", []string{"bind"}, true},
+		{"2001:db8:3::1", []string{"bind"}, false},
+		{"2001:db8:3::1", []string{"Premium"}, true},
+		{"2001:db8:1::1", []string{"premium"}, false},
+	}
+
+	for _, test := range tests {
+		if allowed := registry.Entitled(test.pools).Allows(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf("Entitled(%v).Allows(%s) = %v, expected %v", test.pools, test.ip, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRegistryAdopt(t *testing.T) {
+	previous := newTestRegistry(t)
+
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(poolsConfig), &cfg); err != nil {
+		t.Fatalf("yaml.Unmarshal() returned error: %v", err)
+	}
+	cfg.Pools[0].Prefixes = cfg.Pools[0].Prefixes[:1]
+	cfg.Allocation = map[string]Allocation{"fallback": {Strategy: "lru"}}
+
+	registry, err := newRegistry(&cfg)
+	if err != nil {
+		t.Fatalf("newRegistry() returned error: %v", err)
+	}
+	registry.adopt(previous)
+
+	// Only the unchanged pools keep their allocator
+	expected := map[string]bool{"bind": true, "fallback": false, "ch": true, "premium": false}
+	for i, pool := range registry.Pools() {
+		if kept := pool.Allocator == previous.Pools()[i].Allocator; kept != expected[pool.Name] {
+			t.Errorf("adopt() kept the allocator of %s: %v, expected %v", pool.Name, kept, expected[pool.Name])
+		}
+	}
+}
+
+func TestPickPrefixWeights(t *testing.T) {
+	registry := newTestRegistry(t)
+	pools := mustSelect(t, registry, Selector{Pool: "premium"})
+
+	counts := make(map[string]int)
+	for range 4000 {
+		_, prefix, err := PickPrefix(pools, FamilyAny)
+		if err != nil {
+			t.Fatalf("PickPrefix() returned error: %v", err)
+		}
+		counts[prefix.String()]++
+	}
+
+	light, heavy := counts["2001:db8:3::/48"], counts["2001:db8:4::/48"]
+	if light == 0 || heavy < 2*light {
+		t.Errorf("PickPrefix() does not follow weights: %d vs %d", light, heavy)
+	}
+
+	if _, _, err := PickPrefix(nil, FamilyAny); err != ErrEmptyPool {
+		t.Errorf("PickPrefix() returned %v, expected ErrEmptyPool", err)
+	}
+}
+
+func TestPickPrefixFamily(t *testing.T) {
+	registry := newTestRegistry(t)
+	pools := append(mustSelect(t, registry, Selector{}), registry.Fallback()...)
+
+	for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+		for range 100 {
+			_, prefix, err := PickPrefix(pools, family)
+			if err != nil {
+				t.Fatalf("PickPrefix(%d) returned error: %v", family, err)
+			}
+			if !family.Matches(prefix.IP) {
+				t.Fatalf("PickPrefix(%d) returned %s", family, prefix.String())
+			}
+		}
+	}
+
+	if _, _, err := PickPrefix(registry.Fallback(), FamilyIPv6); err != ErrNoFamilyPrefix {
+		t.Errorf("PickPrefix() returned %v, expected ErrNoFamilyPrefix", err)
+	}
+}
+
+func TestRegistryClassify(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	db, err := geo.ParseCSV(strings.NewReader("2001:db8:1::/49,CH,ZH,Zurich\n2001:db8:1:8000::/49,CH,GE,Geneva\n"))
+	if err != nil {
+		t.Fatalf("geo.ParseCSV() returned error: %v", err)
+	}
+
+	registry.classify(db, 50)
+
+	pools := mustSelect(t, registry, Selector{Tags: map[string]string{"city": "zurich"}})
+	if len(pools) != 2 {
+		t.Fatalf("Select() returned %d pools, expected the premium and classified pools", len(pools))
+	}
+
+	classified := pools[1]
+	if classified.Name != "bind:ch:zh:zurich" || classified.Tags["region"] != "zh" {
+		t.Fatalf("Select() returned %s with tags %v", classified.Name, classified.Tags)
+	}
+
+	if len(classified.Prefixes) != 2 || classified.Prefixes[1].String() != "2001:db8:1:4000::/50" {
+		t.Fatalf("Classified prefixes are %v", classified.Prefixes)
+	}
+
+	if pools := mustSelect(t, registry, Selector{Tags: map[string]string{"region": "ge"}}); len(pools) != 1 {
+		t.Fatalf("Select() returned %d pools, expected the Geneva pool", len(pools))
+	}
+
+	// The pools derived from an entitled pool are entitled too
+	entitled := registry.Entitled([]string{"bind"})
+	if len(entitled.Pools()) != 4 || !entitled.Allows(net.ParseIP("2001:db8:1:4000::1")) {
+		t.Errorf("Entitled(bind) returned %d pools, expected bind, fallback and the classified pools", len(entitled.Pools()))
+	}
+}
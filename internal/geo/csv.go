@@ -0,0 +1,152 @@
+package geo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// CSV is a range file, with one range per line in either form:
+//
+//	start_ip,end_ip,country,region,city
+//	cidr,country,region,city
+//
+// Region and city are optional, lines starting with # are ignored.
+type CSV struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start    netip.Addr
+	end      netip.Addr
+	location Location
+}
+
+// OpenCSV opens and parses a CSV range file
+func OpenCSV(path string) (*CSV, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseCSV(file)
+}
+
+// ParseCSV parses a CSV range file
+func ParseCSV(r io.Reader) (*CSV, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	db := &CSV{}
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		rng, err := parseRange(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		db.ranges = append(db.ranges, rng)
+	}
+
+	slices.SortFunc(db.ranges, func(a, b ipRange) int {
+		return a.start.Compare(b.start)
+	})
+
+	return db, nil
+}
+
+// parseRange parses a line of a CSV range file
+func parseRange(fields []string) (ipRange, error) {
+	var rng ipRange
+
+	if strings.Contains(fields[0], "/") {
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return rng, err
+		}
+		prefix = prefix.Masked()
+
+		rng.start = prefix.Addr()
+		rng.end = lastAddr(prefix)
+		fields = fields[1:]
+	} else {
+		if len(fields) < 2 {
+			return rng, fmt.Errorf("missing end address")
+		}
+
+		var err error
+		if rng.start, err = netip.ParseAddr(fields[0]); err != nil {
+			return rng, err
+		}
+		if rng.end, err = netip.ParseAddr(fields[1]); err != nil {
+			return rng, err
+		}
+		fields = fields[2:]
+	}
+
+	if len(fields) == 0 || fields[0] == "" {
+		return rng, fmt.Errorf("missing country")
+	}
+
+	rng.location.Country = normalize(fields[0])
+	if len(fields) > 1 {
+		rng.location.Region = normalize(fields[1])
+	}
+	if len(fields) > 2 {
+		rng.location.City = normalize(fields[2])
+	}
+
+	return rng, nil
+}
+
+func (db *CSV) Lookup(ip net.IP) (Location, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Location{}, false
+	}
+	addr = addr.Unmap()
+
+	// Last range starting before or at the address
+	i, found := slices.BinarySearchFunc(db.ranges, addr, func(r ipRange, addr netip.Addr) int {
+		return r.start.Compare(addr)
+	})
+	if !found {
+		i--
+	}
+
+	if i < 0 || db.ranges[i].end.Compare(addr) < 0 {
+		return Location{}, false
+	}
+
+	return db.ranges[i].location, true
+}
+
+func (db *CSV) Close() error {
+	return nil
+}
+
+// lastAddr returns the last address of the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
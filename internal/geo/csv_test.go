@@ -0,0 +1,49 @@
+package geo
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const ranges = `# start,end,country,region,city
+2001:db8:1::/48,CH,ZH,Zurich
+2001:db8:2::,2001:db8:2:ffff:ffff:ffff:ffff:ffff,US,NY,New York
+192.0.2.0,192.0.2.127,DE
+`
+
+func TestCSVLookup(t *testing.T) {
+	db, err := ParseCSV(strings.NewReader(ranges))
+	if err != nil {
+		t.Fatalf("ParseCSV() returned error: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		location Location
+		found    bool
+	}{
+		{"2001:db8:1::1", Location{"ch", "zh", "zurich"}, true},
+		{"2001:db8:1:ffff::1", Location{"ch", "zh", "zurich"}, true},
+		{"2001:db8:2:1234::1", Location{"us", "ny", "new_york"}, true},
+		{"2001:db8:3::1", Location{}, false},
+		{"192.0.2.1", Location{Country: "de"}, true},
+		{"192.0.2.200", Location{}, false},
+		{"2001:db8::1", Location{}, false},
+	}
+
+	for _, test := range tests {
+		location, found := db.Lookup(net.ParseIP(test.ip))
+		if found != test.found || location != test.location {
+			t.Errorf("Lookup(%s) = %v, %v, expected %v, %v", test.ip, location, found, test.location, test.found)
+		}
+	}
+}
+
+func TestParseCSVInvalid(t *testing.T) {
+	for _, line := range []string{"nope,CH", "2001:db8::/48", "1.2.3.4,CH"} {
+		if _, err := ParseCSV(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseCSV(%q) returned no error", line)
+		}
+	}
+}
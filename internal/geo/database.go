@@ -0,0 +1,58 @@
+package geo
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Location is the geographical location of an address.
+type Location struct {
+	// Country is the ISO 3166-1 country code, e.g. "ch".
+	Country string
+	// Region is the ISO 3166-2 subdivision code without the country, e.g. "zh".
+	Region string
+	// City is the English name of the city, e.g. "zurich".
+	City string
+}
+
+// Tags returns the non-empty fields of the location as pool tags
+func (l Location) Tags() map[string]string {
+	tags := make(map[string]string, 3)
+	if l.Country != "" {
+		tags["country"] = l.Country
+	}
+	if l.Region != "" {
+		tags["region"] = l.Region
+	}
+	if l.City != "" {
+		tags["city"] = l.City
+	}
+
+	return tags
+}
+
+// Database looks up the location of addresses.
+type Database interface {
+	// Lookup returns the location of the IP, if known.
+	Lookup(ip net.IP) (Location, bool)
+	// Close releases the database.
+	Close() error
+}
+
+// Open opens a local database, either a MaxMind database (.mmdb)
+// or a CSV range file (.csv).
+func Open(path string) (Database, error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return OpenCSV(path)
+	}
+
+	return OpenMMDB(path)
+}
+
+// normalize lowercases the value and replaces the characters which
+// can't be used in username parameters, e.g. "New York" is "new_york".
+func normalize(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	return strings.NewReplacer(" ", "_", "-", "_", ":", "_").Replace(value)
+}
@@ -0,0 +1,56 @@
+package geo
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbRecord is the subset of a GeoIP2 or GeoLite2 City record used to classify addresses.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// MMDB is a MaxMind database.
+type MMDB struct {
+	reader *maxminddb.Reader
+}
+
+// OpenMMDB opens a MaxMind database
+func OpenMMDB(path string) (*MMDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MMDB{reader: reader}, nil
+}
+
+func (db *MMDB) Lookup(ip net.IP) (Location, bool) {
+	var record mmdbRecord
+	if err := db.reader.Lookup(ip, &record); err != nil || record.Country.ISOCode == "" {
+		return Location{}, false
+	}
+
+	location := Location{
+		Country: normalize(record.Country.ISOCode),
+		City:    normalize(record.City.Names["en"]),
+	}
+	if len(record.Subdivisions) > 0 {
+		location.Region = normalize(record.Subdivisions[0].ISOCode)
+	}
+
+	return location, true
+}
+
+func (db *MMDB) Close() error {
+	return db.reader.Close()
+}
@@ -2,11 +2,18 @@ package handlers
 
 import (
 	"bufio"
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/accounting"
+	"github.com/vlourme/go-proxy/internal/auth"
+	"github.com/vlourme/go-proxy/internal/config"
 	httpParse "github.com/vlourme/go-proxy/internal/http"
+	"github.com/vlourme/go-proxy/internal/nio"
 )
 
 func HandleConnection(workerId int, conn net.Conn) {
@@ -38,7 +45,7 @@ func HandleConnection(workerId int, conn net.Conn) {
 
 		var written int64
 		if string(req.Method) == http.MethodConnect {
-			written = HandleTunneling(conn, req)
+			written = HandleTunneling(conn, reader, req)
 		} else {
 			written = HandleHTTP(conn, reader, req)
 		}
@@ -61,3 +68,81 @@ func HandleConnection(workerId int, conn net.Conn) {
 		}
 	}
 }
+
+// getDialOptions returns the dial options of a request to the host from the user and their
+// parameters, which must have been verified beforehand.
+func getDialOptions(username, host string, params map[string]string) nio.DialOptions {
+	ip, _ := auth.GetPinnedIP(params)
+	family, _ := auth.GetFamily(params)
+
+	return nio.DialOptions{
+		User:     username,
+		Session:  params[auth.ParamSession],
+		Timeout:  params[auth.ParamTimeout],
+		Selector: auth.GetSelector(params),
+		Fallback: params[auth.ParamFallback],
+		IP:       ip,
+		Family:   family,
+		Repin:    params[auth.ParamRepin] == "yes",
+		Host:     host,
+	}
+}
+
+// getTimeouts returns the timeouts of the relayed connection: the configured ones,
+// lowered by the parameters which must have been verified beforehand
+func getTimeouts(params map[string]string) nio.Timeouts {
+	cfg := config.Get()
+
+	timeouts := nio.Timeouts{
+		Idle:     time.Duration(cfg.Timeouts.Idle) * time.Second,
+		Lifetime: time.Duration(cfg.Timeouts.Lifetime) * time.Second,
+	}
+	if timeouts.Idle == 0 {
+		timeouts.Idle = time.Duration(cfg.MaxTimeout) * time.Second
+	}
+
+	idle, lifetime, _ := auth.GetTimeouts(params)
+	return timeouts.Lower(nio.Timeouts{Idle: idle, Lifetime: lifetime})
+}
+
+// getDimensions returns what the traffic of the request is accounted by
+func getDimensions(opts nio.DialOptions) accounting.Dimensions {
+	return accounting.Dimensions{
+		User:    opts.User,
+		Session: opts.Session,
+		Country: opts.Selector.Tags["country"],
+	}
+}
+
+// checkACL removes the addresses the user may not connect to on the port, according to the
+// ACL rules of their policy. The selected egress is released if the request is denied.
+func checkACL(opts nio.DialOptions, host, port string, addrs []net.IP, selected *nio.Egress) ([]net.IP, error) {
+	policies := config.GetPolicies()
+	portNum, _ := strconv.Atoi(port)
+
+	var denied *config.ACLRule
+	allowed := make([]net.IP, 0, len(addrs))
+	for _, ip := range addrs {
+		ok, rule := policies.CheckDestination(opts.User, host, ip, portNum)
+		if ok {
+			allowed = append(allowed, ip)
+			continue
+		}
+
+		denied = rule
+		log.Warn().
+			Str("user", opts.User).
+			Str("host", host).
+			Str("ip", ip.String()).
+			Str("port", port).
+			Str("rule", rule.Name).
+			Msg("Destination denied by ACL")
+	}
+
+	if len(allowed) == 0 {
+		selected.Release()
+		return nil, fmt.Errorf("%w: rule %s", config.ErrACLDenied, denied.Name)
+	}
+
+	return allowed, nil
+}
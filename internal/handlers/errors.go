@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/accounting"
+	"github.com/vlourme/go-proxy/internal/alloc"
+	"github.com/vlourme/go-proxy/internal/auth"
+	"github.com/vlourme/go-proxy/internal/config"
+	"github.com/vlourme/go-proxy/internal/limit"
+	"github.com/vlourme/go-proxy/internal/nio"
+	"github.com/vlourme/go-proxy/internal/resolver"
+)
+
+// ErrorHeader is the header of the error responses telling the reason of the failure.
+const ErrorHeader = "X-Proxy-Error"
+
+// Reasons of the failures, sent in the error header so that clients can tell
+// which requests are worth retrying.
+const (
+	ReasonAuthRequired       = "auth_required"
+	ReasonAuthFailed         = "auth_failed"
+	ReasonInvalidParams      = "invalid_params"
+	ReasonIPNotAllowed       = "ip_not_allowed"
+	ReasonNoMatchingPool     = "no_matching_pool"
+	ReasonRateLimited        = "rate_limited"
+	ReasonTooManyConnections = "too_many_connections"
+	ReasonQuotaExceeded      = "quota_exceeded"
+	ReasonDestinationDenied  = "destination_denied"
+	ReasonACLDenied          = "acl_denied"
+	ReasonFamilyUnavailable  = "family_unavailable"
+	ReasonNoEgress           = "no_egress"
+	ReasonDNSNotFound        = "dns_not_found"
+	ReasonDNSFailure         = "dns_failure"
+	ReasonConnectionRefused  = "connection_refused"
+	ReasonConnectionReset    = "connection_reset"
+	ReasonNetworkUnreachable = "network_unreachable"
+	ReasonHostUnreachable    = "host_unreachable"
+	ReasonTimeout            = "timeout"
+	ReasonInternal           = "internal_error"
+)
+
+var (
+	errAuthRequired       = errors.New("proxy authentication required")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// failure is how an error is reported to the client.
+type failure struct {
+	reason string
+	status string
+	reply  byte
+}
+
+// classify returns how the error is reported. Errors joined by Happy Eyeballs are
+// reported by the most telling one: refused, then unreachable, then timed out.
+func classify(err error) failure {
+	switch {
+	case errors.Is(err, errAuthRequired):
+		return failure{ReasonAuthRequired, "407 Proxy Authentication Required", RepConnectionNotAllowed}
+	case errors.Is(err, errInvalidCredentials):
+		return failure{ReasonAuthFailed, "407 Proxy Authentication Required", RepConnectionNotAllowed}
+	case errors.Is(err, config.ErrIPNotAllowed):
+		return failure{ReasonIPNotAllowed, "407 Proxy Authentication Required", RepConnectionNotAllowed}
+	case errors.Is(err, auth.ErrInvalidIP), errors.Is(err, auth.ErrInvalidFamily), errors.Is(err, auth.ErrInvalidTimeout),
+		errors.Is(err, auth.ErrFamilyMismatch):
+		return failure{ReasonInvalidParams, "400 Bad Request", RepConnectionNotAllowed}
+	case errors.Is(err, config.ErrNoMatchingPool):
+		return failure{ReasonNoMatchingPool, "403 Forbidden", RepConnectionNotAllowed}
+	case errors.Is(err, limit.ErrTooManyRequests):
+		return failure{ReasonRateLimited, "429 Too Many Requests", RepConnectionNotAllowed}
+	case errors.Is(err, limit.ErrTooManyConnections):
+		return failure{ReasonTooManyConnections, "429 Too Many Requests", RepConnectionNotAllowed}
+	case errors.Is(err, accounting.ErrQuotaExceeded):
+		return failure{ReasonQuotaExceeded, "403 Forbidden", RepConnectionNotAllowed}
+	case errors.Is(err, nio.ErrDestinationDenied), errors.Is(err, nio.ErrNoLocalhost):
+		return failure{ReasonDestinationDenied, "403 Forbidden", RepConnectionNotAllowed}
+	case errors.Is(err, config.ErrACLDenied):
+		return failure{ReasonACLDenied, "403 Forbidden", RepConnectionNotAllowed}
+	case isFamilyError(err):
+		return failure{ReasonFamilyUnavailable, "502 Bad Gateway", RepNetworkUnreachable}
+	case errors.Is(err, alloc.ErrExhausted), errors.Is(err, config.ErrEmptyPool):
+		return failure{ReasonNoEgress, "503 Service Unavailable", RepGeneralFailure}
+	case errors.Is(err, resolver.ErrNotFound), errors.Is(err, nio.ErrNoIPFound):
+		return failure{ReasonDNSNotFound, "502 Bad Gateway", RepHostUnreachable}
+	case errors.Is(err, resolver.ErrUpstreamFailure), errors.Is(err, resolver.ErrNoUpstream), errors.Is(err, resolver.ErrNoUpstreamFamily):
+		return failure{ReasonDNSFailure, "502 Bad Gateway", RepHostUnreachable}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failure{ReasonConnectionRefused, "502 Bad Gateway", RepConnectionRefused}
+	case errors.Is(err, syscall.ENETUNREACH):
+		return failure{ReasonNetworkUnreachable, "502 Bad Gateway", RepNetworkUnreachable}
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return failure{ReasonHostUnreachable, "502 Bad Gateway", RepHostUnreachable}
+	case isTimeout(err):
+		return failure{ReasonTimeout, "504 Gateway Timeout", RepTTLExpired}
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return failure{ReasonConnectionReset, "502 Bad Gateway", RepGeneralFailure}
+	default:
+		return failure{ReasonInternal, "500 Internal Server Error", RepGeneralFailure}
+	}
+}
+
+// isTimeout returns whether the error is a timeout, of a deadline or of the network
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isFamilyError returns whether the requested address family is impossible for the target
+func isFamilyError(err error) bool {
+	return errors.Is(err, nio.ErrNoFamilyIP) || errors.Is(err, nio.ErrSessionFamily) ||
+		errors.Is(err, config.ErrNoFamilyPrefix) || errors.Is(err, nio.ErrFamilyMismatch)
+}
+
+// headers returns the extra headers of the response of the failure: the authentication
+// challenge of 407 responses
+func (f failure) headers() string {
+	if strings.HasPrefix(f.status, "407") {
+		return "Proxy-Authenticate: Basic\r\n"
+	}
+
+	return ""
+}
+
+// writeDialError writes the response of an error resolving or dialing the target
+func writeDialError(w net.Conn, err error) {
+	f := classify(err)
+	writeError(w, f.status, f.reason, f.headers(), err)
+}
+
+// dialErrorReply returns the SOCKS5 reply of an error resolving or dialing the target
+func dialErrorReply(err error) byte {
+	return classify(err).reply
+}
+
+// writeError writes an error response explaining the failure, with its reason
+// in the error header and the extra headers, each ending with CRLF
+func writeError(w net.Conn, status, reason, headers string, err error) {
+	msg := err.Error()
+	fmt.Fprintf(w, "HTTP/1.1 %s\r\n%s: %s\r\n%sContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s",
+		status, ErrorHeader, reason, headers, len(msg), msg)
+}
+
+// writeAuthError writes the response explaining why the credentials or parameters were rejected:
+// a 407 with the authentication challenge for the credentials, a 400 for invalid parameters
+func writeAuthError(w net.Conn, err error) {
+	writeDialError(w, err)
+}
+
+// writeLimitError writes a 429 response explaining which limit the user exceeded
+func writeLimitError(w net.Conn, err error) {
+	retryAfter := fmt.Sprintf("Retry-After: %d\r\n", int(limit.RetryAfter/time.Second))
+	writeError(w, "429 Too Many Requests", classify(err).reason, retryAfter, err)
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/vlourme/go-proxy/internal/accounting"
+	"github.com/vlourme/go-proxy/internal/alloc"
+	"github.com/vlourme/go-proxy/internal/auth"
+	"github.com/vlourme/go-proxy/internal/config"
+	"github.com/vlourme/go-proxy/internal/limit"
+	"github.com/vlourme/go-proxy/internal/nio"
+	"github.com/vlourme/go-proxy/internal/resolver"
+)
+
+func TestClassify(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
+	tests := []struct {
+		err    error
+		reason string
+		status string
+		reply  byte
+	}{
+		{errAuthRequired, ReasonAuthRequired, "407 Proxy Authentication Required", RepConnectionNotAllowed},
+		{errInvalidCredentials, ReasonAuthFailed, "407 Proxy Authentication Required", RepConnectionNotAllowed},
+		{auth.ErrInvalidFamily, ReasonInvalidParams, "400 Bad Request", RepConnectionNotAllowed},
+		{auth.ErrFamilyMismatch, ReasonInvalidParams, "400 Bad Request", RepConnectionNotAllowed},
+		{config.ErrIPNotAllowed, ReasonIPNotAllowed, "407 Proxy Authentication Required", RepConnectionNotAllowed},
+		{config.ErrNoMatchingPool, ReasonNoMatchingPool, "403 Forbidden", RepConnectionNotAllowed},
+		{limit.ErrTooManyRequests, ReasonRateLimited, "429 Too Many Requests", RepConnectionNotAllowed},
+		{accounting.ErrQuotaExceeded, ReasonQuotaExceeded, "403 Forbidden", RepConnectionNotAllowed},
+		{fmt.Errorf("%w: rule no-smtp", config.ErrACLDenied), ReasonACLDenied, "403 Forbidden", RepConnectionNotAllowed},
+		{nio.ErrDestinationDenied, ReasonDestinationDenied, "403 Forbidden", RepConnectionNotAllowed},
+		{nio.ErrNoFamilyIP, ReasonFamilyUnavailable, "502 Bad Gateway", RepNetworkUnreachable},
+		{alloc.ErrExhausted, ReasonNoEgress, "503 Service Unavailable", RepGeneralFailure},
+		{resolver.ErrNotFound, ReasonDNSNotFound, "502 Bad Gateway", RepHostUnreachable},
+		{fmt.Errorf("%w: %w", resolver.ErrUpstreamFailure, timeout), ReasonDNSFailure, "502 Bad Gateway", RepHostUnreachable},
+		{refused, ReasonConnectionRefused, "502 Bad Gateway", RepConnectionRefused},
+		{unreachable, ReasonNetworkUnreachable, "502 Bad Gateway", RepNetworkUnreachable},
+		{timeout, ReasonTimeout, "504 Gateway Timeout", RepTTLExpired},
+		{errors.Join(timeout, unreachable, refused), ReasonConnectionRefused, "502 Bad Gateway", RepConnectionRefused},
+		{errors.New("boom"), ReasonInternal, "500 Internal Server Error", RepGeneralFailure},
+	}
+
+	for _, test := range tests {
+		f := classify(test.err)
+		if f.reason != test.reason || f.status != test.status || f.reply != test.reply {
+			t.Errorf("classify(%v) = %+v, expected {%s %s %d}", test.err, f, test.reason, test.status, test.reply)
+		}
+	}
+}
+
+func TestFailureHeaders(t *testing.T) {
+	if headers := classify(errInvalidCredentials).headers(); headers != "Proxy-Authenticate: Basic\r\n" {
+		t.Errorf("headers() returned %q for invalid credentials, expected the challenge", headers)
+	}
+
+	if headers := classify(auth.ErrInvalidFamily).headers(); headers != "" {
+		t.Errorf("headers() returned %q for an invalid parameter, expected none", headers)
+	}
+}
+
+func TestClassifyDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned error: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Fatalf("net.Dial(%s) succeeded on a closed listener", addr)
+	}
+
+	if reason := classify(err).reason; reason != ReasonConnectionRefused {
+		t.Errorf("classify(%v) returned reason %s, expected %s", err, reason, ReasonConnectionRefused)
+	}
+}
@@ -3,12 +3,14 @@ package handlers
 import (
 	"bufio"
 	"net"
-	"time"
+	"strings"
 
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/accounting"
 	"github.com/vlourme/go-proxy/internal/auth"
 	"github.com/vlourme/go-proxy/internal/config"
 	"github.com/vlourme/go-proxy/internal/http"
+	"github.com/vlourme/go-proxy/internal/limit"
 	"github.com/vlourme/go-proxy/internal/nio"
 )
 
@@ -17,11 +19,35 @@ func HandleHTTP(w net.Conn, buf *bufio.Reader, r *http.Request) int64 {
 	username, password, encodedParams := auth.GetCredentials(r)
 	if !auth.Verify(username, password) {
 		log.Error().Msg("Invalid credentials")
-		w.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		if username == "" {
+			writeAuthError(w, errAuthRequired)
+		} else {
+			writeAuthError(w, errInvalidCredentials)
+		}
 		return -1
 	}
 
 	params := auth.GetParams(encodedParams)
+	if err := auth.VerifyParams(params); err != nil {
+		log.Error().Err(err).Msg("Invalid parameters")
+		writeAuthError(w, err)
+		return -1
+	}
+
+	limits := auth.GetLimits(username)
+	lease, err := limit.Acquire(username, limits)
+	if err != nil {
+		log.Warn().Err(err).Str("user", username).Msg("Limit exceeded")
+		writeLimitError(w, err)
+		return -1
+	}
+	defer lease.Release()
+
+	if err := accounting.Check(username, limits); err != nil {
+		log.Warn().Err(err).Str("user", username).Msg("Quota exceeded")
+		writeDialError(w, err)
+		return -1
+	}
 
 	// Check if this is a WebSocket upgrade request
 	upgradeHeader := r.Header["Upgrade"]
@@ -35,47 +61,65 @@ func HandleHTTP(w net.Conn, buf *bufio.Reader, r *http.Request) int64 {
 		delete(r.Header, header)
 	}
 
-	ip, err := nio.ResolveHostname(string(r.Host))
+	// Bodies matched against the ban patterns must not be compressed
+	if rules := config.GetBanRules(); rules.Enabled && len(rules.Patterns) > 0 {
+		for header := range r.Header {
+			if strings.EqualFold(header, "Accept-Encoding") {
+				delete(r.Header, header)
+			}
+		}
+	}
+
+	opts := getDialOptions(username, string(r.Host), params)
+	addrs, selected, err := nio.ResolveHostname(string(r.Host), opts)
 	if err != nil {
 		log.Error().Err(err).Msg("Error resolving hostname")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
 
-	dialer, err := nio.GetDialer(
-		ip,
-		params[auth.ParamSession],
-		params[auth.ParamTimeout],
-		params[auth.ParamLocation],
-		params[auth.ParamFallback],
-	)
+	addrs, err = checkACL(opts, string(r.Host), string(r.Port), addrs, selected)
 	if err != nil {
-		log.Error().Err(err).Msg("Error getting dialer")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
 
-	destConn, err := dialer.Dial("tcp", ip+":"+string(r.Port))
+	destConn, egress, err := nio.Dial(addrs, string(r.Port), opts, selected)
 	if err != nil {
 		log.Error().Err(err).Msg("Error dialing")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
-
+	defer egress.Release()
 	defer destConn.Close()
-	_, err = r.WriteTo(destConn, buf)
+
+	destConn = nio.WatchBans(destConn, string(r.Host), opts, config.GetBanRules())
+
+	shaper := nio.NewShaper(username, limits)
+	defer shaper.Release()
+
+	meter, err := accounting.Open(getDimensions(opts), limits, func() {
+		w.Close()
+		destConn.Close()
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("user", username).Msg("Quota exceeded")
+		writeDialError(w, err)
+		return -1
+	}
+	defer meter.Close()
+
+	written, err := r.WriteTo(shaper.Writer(destConn), buf)
+	meter.Upload(int(written))
 	if err != nil {
 		log.Error().Err(err).Msg("Error writing request")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
 
-	// For WebSocket connections, use longer timeout and bidirectional copy
 	if isWebSocket {
 		log.Debug().Str("upgrade", string(upgradeHeader)).Msg("WebSocket upgrade detected")
-		// Use much longer timeout for WebSocket persistent connections
-		return nio.CopyOnce(w, destConn, time.Duration(config.Get().MaxTimeout)*10*time.Second)
 	}
 
-	return nio.CopyOnce(w, destConn, time.Duration(config.Get().MaxTimeout)*time.Second)
+	return nio.CopyOnce(w, destConn, buf, getTimeouts(params), shaper, meter)
 }
@@ -1,61 +1,109 @@
 package handlers
 
 import (
+	"bufio"
+	"fmt"
 	"net"
-	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/accounting"
 	"github.com/vlourme/go-proxy/internal/auth"
 	"github.com/vlourme/go-proxy/internal/config"
 	"github.com/vlourme/go-proxy/internal/http"
+	"github.com/vlourme/go-proxy/internal/limit"
 	"github.com/vlourme/go-proxy/internal/nio"
 )
 
 // HandleTunneling handles the HTTPS tunneling request
-func HandleTunneling(w net.Conn, r *http.Request) int64 {
+func HandleTunneling(w net.Conn, buf *bufio.Reader, r *http.Request) int64 {
 	username, password, encodedParams := auth.GetCredentials(r)
 	if username == "" {
 		log.Error().Msg("No username provided")
-		w.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n"))
+		writeAuthError(w, errAuthRequired)
 		return -1
 	}
 
 	if !auth.Verify(username, password) {
 		log.Error().Msg("Invalid credentials")
-		w.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n"))
+		writeAuthError(w, errInvalidCredentials)
 		return -1
 	}
 
 	params := auth.GetParams(encodedParams)
+	if err := auth.VerifyParams(params); err != nil {
+		log.Error().Err(err).Msg("Invalid parameters")
+		writeAuthError(w, err)
+		return -1
+	}
+
+	limits := auth.GetLimits(username)
+	lease, err := limit.Acquire(username, limits)
+	if err != nil {
+		log.Warn().Err(err).Str("user", username).Msg("Limit exceeded")
+		writeLimitError(w, err)
+		return -1
+	}
+	defer lease.Release()
 
-	ip, err := nio.ResolveHostname(string(r.Host))
+	if err := accounting.Check(username, limits); err != nil {
+		log.Warn().Err(err).Str("user", username).Msg("Quota exceeded")
+		writeDialError(w, err)
+		return -1
+	}
+
+	opts := getDialOptions(username, string(r.Host), params)
+	addrs, selected, err := nio.ResolveHostname(string(r.Host), opts)
 	if err != nil {
 		log.Error().Err(err).Msg("Error resolving hostname")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
 
-	dialer, err := nio.GetDialer(
-		ip,
-		params[auth.ParamSession],
-		params[auth.ParamTimeout],
-		params[auth.ParamLocation],
-		params[auth.ParamFallback],
-	)
+	addrs, err = checkACL(opts, string(r.Host), string(r.Port), addrs, selected)
 	if err != nil {
-		log.Error().Err(err).Msg("Error getting dialer")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
 
-	destConn, err := dialer.Dial("tcp", ip+":"+string(r.Port))
+	destConn, egress, err := nio.Dial(addrs, string(r.Port), opts, selected)
 	if err != nil {
 		log.Error().Err(err).Msg("Error dialing")
-		w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		writeDialError(w, err)
 		return -1
 	}
+	defer egress.Release()
 	defer destConn.Close()
 
-	w.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-	return nio.CopyOnce(w, destConn, time.Duration(config.Get().MaxTimeout)*time.Second)
+	shaper := nio.NewShaper(username, limits)
+	defer shaper.Release()
+
+	meter, err := accounting.Open(getDimensions(opts), limits, func() {
+		w.Close()
+		destConn.Close()
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("user", username).Msg("Quota exceeded")
+		writeDialError(w, err)
+		return -1
+	}
+	defer meter.Close()
+
+	w.Write(connectResponse(destConn.LocalAddr(), opts.Session))
+	return nio.CopyOnce(w, destConn, buf, getTimeouts(params), shaper, meter)
+}
+
+// connectResponse returns the response of an established tunnel, with the egress address
+// and the session in the proxy headers if enabled
+func connectResponse(local net.Addr, session string) []byte {
+	headers := config.Get().ProxyHeaders
+
+	resp := []byte("HTTP/1.1 200 Connection Established\r\n")
+	if addr, ok := local.(*net.TCPAddr); ok && headers.IP {
+		resp = fmt.Appendf(resp, "X-Proxy-IP: %s\r\n", addr.IP)
+	}
+	if session != "" && headers.Session {
+		resp = fmt.Appendf(resp, "X-Proxy-Session: %s\r\n", session)
+	}
+
+	return append(resp, "\r\n"...)
 }
@@ -8,11 +8,11 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/accounting"
 	"github.com/vlourme/go-proxy/internal/auth"
-	"github.com/vlourme/go-proxy/internal/config"
+	"github.com/vlourme/go-proxy/internal/limit"
 	"github.com/vlourme/go-proxy/internal/nio"
 )
 
@@ -120,6 +120,11 @@ func HandleSocks5(conn net.Conn, buf *bufio.Reader) int64 {
 		return -1
 	}
 	params := auth.GetParams(paramStr)
+	if err := auth.VerifyParams(params); err != nil {
+		conn.Write([]byte{0x01, 0x01})
+		log.Error().Err(err).Msg("failed to verify params")
+		return -1
+	}
 	conn.Write([]byte{0x01, 0x00})
 
 	hdr := make([]byte, 4)
@@ -129,46 +134,93 @@ func HandleSocks5(conn net.Conn, buf *bufio.Reader) int64 {
 	}
 
 	addrType := hdr[3]
-	ip, port, err := parseAtyp(addrType, buf)
+	host, port, err := parseAtyp(addrType, buf)
 	if err != nil {
 		writeStatus(conn, RepAddrTypeNotSupported)
 		log.Error().Err(err).Msg("failed to parse address")
 		return -1
 	}
 
-	dialer, err := nio.GetDialer(
-		ip,
-		params[auth.ParamSession],
-		params[auth.ParamTimeout],
-		params[auth.ParamLocation],
-		params[auth.ParamFallback],
-	)
+	// The request is read before replying, so that clients get the reply they wait for
+	limits := auth.GetLimits(username)
+	lease, err := limit.Acquire(username, limits)
 	if err != nil {
-		writeStatus(conn, RepGeneralFailure)
-		log.Error().Err(err).Msg("failed to get dialer")
+		writeStatus(conn, dialErrorReply(err))
+		log.Warn().Err(err).Str("user", username).Msg("limit exceeded")
+		return -1
+	}
+	defer lease.Release()
+
+	if err := accounting.Check(username, limits); err != nil {
+		writeStatus(conn, dialErrorReply(err))
+		log.Warn().Err(err).Str("user", username).Msg("quota exceeded")
+		return -1
+	}
+
+	opts := getDialOptions(username, host, params)
+	addrs, selected, err := nio.ResolveHostname(host, opts)
+	if err != nil {
+		writeStatus(conn, dialErrorReply(err))
+		log.Error().Err(err).Msg("failed to resolve hostname")
+		return -1
+	}
+
+	addrs, err = checkACL(opts, host, strconv.Itoa(int(port)), addrs, selected)
+	if err != nil {
+		writeStatus(conn, dialErrorReply(err))
 		return -1
 	}
 
-	destConn, err := dialer.Dial("tcp", ip+":"+strconv.Itoa(int(port)))
+	destConn, egress, err := nio.Dial(addrs, strconv.Itoa(int(port)), opts, selected)
 	if err != nil {
-		writeStatus(conn, RepHostUnreachable)
+		writeStatus(conn, dialErrorReply(err))
 		log.Error().Err(err).Msg("failed to dial")
 		return -1
 	}
+	defer egress.Release()
 	defer destConn.Close()
 
-	writeStatus(conn, RepSuccess)
+	shaper := nio.NewShaper(username, limits)
+	defer shaper.Release()
+
+	meter, err := accounting.Open(getDimensions(opts), limits, func() {
+		conn.Close()
+		destConn.Close()
+	})
+	if err != nil {
+		writeStatus(conn, dialErrorReply(err))
+		log.Warn().Err(err).Str("user", username).Msg("quota exceeded")
+		return -1
+	}
+	defer meter.Close()
+
+	writeReply(conn, RepSuccess, destConn.LocalAddr())
 
-	return nio.CopyOnce(destConn, conn, time.Duration(config.Get().MaxTimeout)*time.Second)
+	return nio.CopyOnce(conn, destConn, buf, getTimeouts(params), shaper, meter)
 }
 
-// writeStatus writes a standardized SOCKS5 reply to the client
+// writeStatus writes a standardized SOCKS5 reply to the client, without bound address
 func writeStatus(conn net.Conn, reply byte) {
-	resp := []byte{
-		Version5, reply, 0x00, AtypIPv4,
-		0x00, 0x00, 0x00, 0x00, // Dummy IP
-		0x00, 0x00, // Dummy port
+	writeReply(conn, reply, nil)
+}
+
+// writeReply writes a SOCKS5 reply to the client with the bound address, 0.0.0.0:0 if not TCP
+func writeReply(conn net.Conn, reply byte, bound net.Addr) {
+	ip, port := net.IP(net.IPv4zero), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+
+	resp := []byte{Version5, reply, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		resp = append(resp, AtypIPv4)
+		resp = append(resp, ip4...)
+	} else {
+		resp = append(resp, AtypIPv6)
+		resp = append(resp, ip.To16()...)
 	}
+	resp = binary.BigEndian.AppendUint16(resp, uint16(port))
+
 	conn.Write(resp)
 }
 
@@ -197,7 +249,7 @@ func parseSocksAuth(buf *bufio.Reader) (string, string, error) {
 	return string(ubuf), string(pbuf), nil
 }
 
-// parseAtyp parses the address type and returns the address and port
+// parseAtyp parses the address type and returns the address or domain and port
 func parseAtyp(atyp byte, buf *bufio.Reader) (string, uint16, error) {
 	switch atyp {
 	case AtypIPv4:
@@ -220,11 +272,7 @@ func parseAtyp(atyp byte, buf *bufio.Reader) (string, uint16, error) {
 
 		host := string(domainBuf[:domainLen])
 		port := binary.BigEndian.Uint16(domainBuf[domainLen:])
-		ip, err := nio.ResolveHostname(host)
-		if err != nil {
-			return "", 0, fmt.Errorf("resolve hostname: %w", err)
-		}
-		return ip, port, nil
+		return host, port, nil
 
 	case AtypIPv6:
 		addr := make([]byte, 18)
@@ -233,7 +281,7 @@ func parseAtyp(atyp byte, buf *bufio.Reader) (string, uint16, error) {
 		}
 		ip := net.IP(addr[:16])
 		port := binary.BigEndian.Uint16(addr[16:])
-		return "[" + ip.String() + "]", port, nil
+		return ip.String(), port, nil
 
 	default:
 		return "", 0, fmt.Errorf("unsupported address type: %d", atyp)
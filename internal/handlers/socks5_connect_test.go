@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWriteReply(t *testing.T) {
+	tests := []struct {
+		bound    net.Addr
+		expected []byte
+	}{
+		{nil, []byte{Version5, RepSuccess, 0x00, AtypIPv4, 0, 0, 0, 0, 0, 0}},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, []byte{Version5, RepSuccess, 0x00, AtypIPv4, 192, 0, 2, 1, 0x01, 0xbb}},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8080},
+			[]byte{Version5, RepSuccess, 0x00, AtypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x1f, 0x90},
+		},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			writeReply(server, RepSuccess, test.bound)
+			server.Close()
+		}()
+
+		resp, err := io.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll() returned error: %v", err)
+		}
+		if !bytes.Equal(resp, test.expected) {
+			t.Errorf("writeReply(%v) wrote %v, expected %v", test.bound, resp, test.expected)
+		}
+	}
+}
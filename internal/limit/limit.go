@@ -0,0 +1,78 @@
+package limit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+var (
+	ErrTooManyConnections = errors.New("too many concurrent connections")
+	ErrTooManyRequests    = errors.New("too many requests per second")
+)
+
+// RetryAfter is the delay after which an over-limit request may be retried.
+const RetryAfter = time.Second
+
+// backend counts the requests and connections of the users.
+type backend interface {
+	// allow returns whether the user made at most rps requests in the current second, this one included
+	allow(user string, rps int) bool
+	// acquire registers the connection unless the user already has max ones
+	acquire(user, id string, max int) bool
+	// release unregisters the connection
+	release(user, id string)
+}
+
+// Lease is a connection counted against the concurrency limit of its user.
+type Lease struct {
+	user    string
+	id      string
+	backend backend
+}
+
+// Release stops counting the connection. It is nil-safe.
+func (l *Lease) Release() {
+	if l == nil {
+		return
+	}
+
+	l.backend.release(l.user, l.id)
+}
+
+// local counts on this node only.
+var local = newLocalBackend()
+
+// getBackend returns the Redis backend shared by the nodes when the Redis authentication
+// is configured, the local one otherwise
+func getBackend() backend {
+	if config.Get().Auth.Type == config.AuthTypeRedis {
+		return getRedisBackend()
+	}
+
+	return local
+}
+
+// Acquire checks the request rate and the concurrent connections of the user against their limits.
+// The returned lease must be released when the connection is closed, it is nil without concurrency limit.
+func Acquire(user string, limits config.Limits) (*Lease, error) {
+	return acquire(getBackend(), user, limits)
+}
+
+func acquire(b backend, user string, limits config.Limits) (*Lease, error) {
+	if limits.RequestsPerSecond > 0 && !b.allow(user, limits.RequestsPerSecond) {
+		return nil, ErrTooManyRequests
+	}
+
+	if limits.MaxConnections <= 0 {
+		return nil, nil
+	}
+
+	lease := &Lease{user: user, id: newID(), backend: b}
+	if !b.acquire(user, lease.id, limits.MaxConnections) {
+		return nil, ErrTooManyConnections
+	}
+
+	return lease, nil
+}
@@ -0,0 +1,54 @@
+package limit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+func TestAcquireConnections(t *testing.T) {
+	b := newLocalBackend()
+	limits := config.Limits{MaxConnections: 2}
+
+	first, err := acquire(b, "john", limits)
+	if err != nil {
+		t.Fatalf("acquire() returned error: %v", err)
+	}
+	if _, err := acquire(b, "john", limits); err != nil {
+		t.Fatalf("acquire() returned error: %v", err)
+	}
+
+	if _, err := acquire(b, "john", limits); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("acquire() returned %v, expected ErrTooManyConnections", err)
+	}
+	if _, err := acquire(b, "jane", limits); err != nil {
+		t.Errorf("acquire() returned %v for another user", err)
+	}
+
+	first.Release()
+	if _, err := acquire(b, "john", limits); err != nil {
+		t.Errorf("acquire() returned %v after a release", err)
+	}
+
+	if lease, err := acquire(b, "john", config.Limits{}); lease != nil || err != nil {
+		t.Errorf("acquire() returned %v, %v without limits", lease, err)
+	}
+}
+
+func TestAcquireRequests(t *testing.T) {
+	b := newLocalBackend()
+	limits := config.Limits{RequestsPerSecond: 3}
+
+	// The window may roll over during the test, allowing more requests
+	denied := 0
+	for range 10 {
+		if _, err := acquire(b, "john", limits); errors.Is(err, ErrTooManyRequests) {
+			denied++
+		}
+	}
+
+	if denied < 4 {
+		t.Errorf("acquire() denied %d requests out of 10, expected at least 4", denied)
+	}
+}
@@ -0,0 +1,82 @@
+package limit
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// localBackend counts the requests and connections in memory.
+type localBackend struct {
+	mu          sync.Mutex
+	windows     map[string]*window
+	connections map[string]int
+}
+
+// window is the number of requests of a user during a second.
+type window struct {
+	second int64
+	count  int
+}
+
+func newLocalBackend() *localBackend {
+	return &localBackend{
+		windows:     make(map[string]*window),
+		connections: make(map[string]int),
+	}
+}
+
+func (b *localBackend) allow(user string, rps int) bool {
+	now := time.Now().Unix()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w, ok := b.windows[user]
+	if !ok || w.second != now {
+		// Drop the windows of past seconds once in a while
+		if len(b.windows) >= 1024 {
+			for key, w := range b.windows {
+				if w.second != now {
+					delete(b.windows, key)
+				}
+			}
+		}
+
+		w = &window{second: now}
+		b.windows[user] = w
+	}
+
+	w.count++
+	return w.count <= rps
+}
+
+func (b *localBackend) acquire(user, id string, max int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.connections[user] >= max {
+		return false
+	}
+
+	b.connections[user]++
+	return true
+}
+
+func (b *localBackend) release(user, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.connections[user]--
+	if b.connections[user] <= 0 {
+		delete(b.connections, user)
+	}
+}
+
+var lastID atomic.Uint64
+
+// newID returns an identifier of the connection, unique on this node
+func newID() string {
+	return strconv.FormatUint(lastID.Add(1), 36)
+}
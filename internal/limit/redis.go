@@ -0,0 +1,167 @@
+package limit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/auth"
+)
+
+const (
+	// connectionLease is how long a connection is counted without being refreshed,
+	// so that the connections of a node which died are dropped shortly.
+	connectionLease = 2 * time.Minute
+	// heartbeatInterval is the interval between refreshes of the live connections.
+	heartbeatInterval = 30 * time.Second
+)
+
+// acquireScript registers the connection in the sorted set of the user, scored by
+// the time it was last refreshed, unless the user already has the maximum number of live connections.
+var acquireScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+// redisBackend counts the requests and connections in Redis, shared by the nodes.
+// Requests are allowed if Redis fails. The live connections of the node are refreshed
+// by a heartbeat for as long as they are open.
+type redisBackend struct {
+	client *redis.Client
+	node   string
+
+	mu sync.Mutex
+	// live are the ids of the live connections of the node, by user
+	live map[string]map[string]struct{}
+}
+
+var redisOnce sync.Once
+var redisInstance *redisBackend
+
+func getRedisBackend() *redisBackend {
+	redisOnce.Do(func() {
+		hostname, _ := os.Hostname()
+		redisInstance = &redisBackend{
+			client: auth.GetRedisClient(),
+			node:   fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+			live:   make(map[string]map[string]struct{}),
+		}
+		go redisInstance.heartbeat()
+	})
+
+	return redisInstance
+}
+
+func (b *redisBackend) allow(user string, rps int) bool {
+	ctx := context.Background()
+	key := fmt.Sprintf("ratelimit:rps:%s:%d", user, time.Now().Unix())
+
+	pipe := b.client.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to count request")
+		return true
+	}
+
+	return count.Val() <= int64(rps)
+}
+
+func (b *redisBackend) acquire(user, id string, max int) bool {
+	now := time.Now()
+	args := []any{
+		now.Add(-connectionLease).UnixMilli(),
+		now.UnixMilli(),
+		max,
+		b.member(id),
+		connectionLease.Milliseconds(),
+	}
+
+	ok, err := acquireScript.Run(context.Background(), b.client, []string{connectionsKey(user)}, args...).Int()
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to count connection")
+		return true
+	}
+	if ok != 1 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.live[user] == nil {
+		b.live[user] = make(map[string]struct{})
+	}
+	b.live[user][id] = struct{}{}
+
+	return true
+}
+
+func (b *redisBackend) release(user, id string) {
+	b.mu.Lock()
+	delete(b.live[user], id)
+	if len(b.live[user]) == 0 {
+		delete(b.live, user)
+	}
+	b.mu.Unlock()
+
+	if err := b.client.ZRem(context.Background(), connectionsKey(user), b.member(id)).Err(); err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to release connection")
+	}
+}
+
+// heartbeat refreshes the live connections of the node every interval, forever
+func (b *redisBackend) heartbeat() {
+	for range time.Tick(heartbeatInterval) {
+		b.refresh()
+	}
+}
+
+// refresh scores the live connections of the node with the current time, so that they
+// keep counting. Released connections are not added back.
+func (b *redisBackend) refresh() {
+	now := float64(time.Now().UnixMilli())
+
+	b.mu.Lock()
+	members := make(map[string][]redis.Z, len(b.live))
+	for user, ids := range b.live {
+		for id := range ids {
+			members[user] = append(members[user], redis.Z{Score: now, Member: b.member(id)})
+		}
+	}
+	b.mu.Unlock()
+
+	if len(members) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := b.client.Pipeline()
+	for user, zs := range members {
+		pipe.ZAddXX(ctx, connectionsKey(user), zs...)
+		pipe.PExpire(ctx, connectionsKey(user), connectionLease)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Error().Err(err).Int("users", len(members)).Msg("Failed to refresh connections")
+	}
+}
+
+// member returns the member of the connection in the sorted set, unique across the nodes
+func (b *redisBackend) member(id string) string {
+	return b.node + ":" + id
+}
+
+// connectionsKey returns the key of the sorted set of the connections of the user
+func connectionsKey(user string) string {
+	return "ratelimit:connections:" + user
+}
@@ -0,0 +1,263 @@
+package nio
+
+import (
+	"bytes"
+	"cmp"
+	"io"
+	"net"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+// banSubnet is the length of the IPv6 subnets banned as a whole.
+const banSubnet = 64
+
+// maxHeaderSize is the size of the response headers inspected for a ban, larger ones are not.
+const maxHeaderSize = 16 * 1024
+
+// Ban is an egress address or subnet banned by a target host.
+type Ban struct {
+	Host   string    `json:"host"`
+	Egress string    `json:"egress"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+type banKey struct {
+	host   string
+	egress string
+}
+
+// BanList holds the egress addresses and subnets banned by each host until their cool-down is over.
+type BanList struct {
+	mu   sync.Mutex
+	bans map[banKey]Ban
+	now  func() time.Time
+}
+
+var bans = newBanList()
+
+// newBanList returns an empty ban list
+func newBanList() *BanList {
+	return &BanList{bans: make(map[banKey]Ban), now: time.Now}
+}
+
+// GetBans returns the egress addresses banned by the targets
+func GetBans() *BanList {
+	return bans
+}
+
+// normalizeHost returns the host as the bans are keyed by
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+}
+
+// banKeys returns the keys of the address and of its subnet for the host
+func banKeys(host string, ip net.IP) []banKey {
+	host = normalizeHost(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return []banKey{{host, ip4.String() + "/32"}}
+	}
+
+	subnet := net.IPNet{IP: ip.Mask(net.CIDRMask(banSubnet, 128)), Mask: net.CIDRMask(banSubnet, 128)}
+	return []banKey{{host, ip.String() + "/128"}, {host, subnet.String()}}
+}
+
+// Ban bans the egress address for the host during the cool-down, or its /64 if subnet is set
+func (b *BanList) Ban(host string, ip net.IP, subnet bool, cooldown time.Duration, reason string) {
+	keys := banKeys(host, ip)
+	key := keys[0]
+	if subnet {
+		key = keys[len(keys)-1]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for k, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, k)
+		}
+	}
+
+	b.bans[key] = Ban{Host: key.host, Egress: key.egress, Reason: reason, Until: now.Add(cooldown)}
+}
+
+// Banned returns whether the egress address, or its /64, is banned by the host
+func (b *BanList) Banned(host string, ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.bans) == 0 {
+		return false
+	}
+
+	now := b.now()
+	for _, key := range banKeys(host, ip) {
+		if ban, ok := b.bans[key]; ok && now.Before(ban.Until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// List returns the bans in force, sorted by host and egress
+func (b *BanList) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	list := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			list = append(list, ban)
+		}
+	}
+
+	slices.SortFunc(list, func(a, b Ban) int {
+		return cmp.Or(cmp.Compare(a.Host, b.Host), cmp.Compare(a.Egress, b.Egress))
+	})
+
+	return list
+}
+
+// banWatcher inspects the first response read from the target for the signals of a ban:
+// its status code, then the start of its body. Chunked bodies are decoded, bodies with
+// any other content encoding are not inspected.
+type banWatcher struct {
+	net.Conn
+	rules *config.BanRules
+	onBan func(reason string)
+
+	buf     []byte
+	header  int
+	chunked bool
+	done    bool
+}
+
+// WatchBans returns the connection to the target of the host, banning its egress for the host
+// when the first response read from it matches the ban rules. Sessions banned by the host get
+// a new address on their next request to it if the rules re-pin them.
+func WatchBans(conn net.Conn, host string, opts DialOptions, rules *config.BanRules) net.Conn {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !rules.Enabled || !ok {
+		return conn
+	}
+
+	return &banWatcher{
+		Conn:   conn,
+		rules:  rules,
+		header: -1,
+		onBan: func(reason string) {
+			bans.Ban(host, local.IP, rules.Subnet, rules.Cooldown, reason)
+			log.Warn().
+				Str("host", host).
+				Str("egress", local.IP.String()).
+				Str("session", opts.Session).
+				Str("reason", reason).
+				Msg("Egress banned by target")
+		},
+	}
+}
+
+func (w *banWatcher) Read(p []byte) (int, error) {
+	n, err := w.Conn.Read(p)
+	if n > 0 && !w.done {
+		w.inspect(p[:n])
+		if w.done {
+			w.buf = nil
+		}
+	}
+
+	return n, err
+}
+
+// CloseWrite half-closes the connection to the target, if it can be
+func (w *banWatcher) CloseWrite() error {
+	if conn, ok := w.Conn.(closeWriter); ok {
+		return conn.CloseWrite()
+	}
+
+	return nil
+}
+
+// inspect adds the bytes read to the start of the response, and looks for a ban once the
+// headers are complete
+func (w *banWatcher) inspect(data []byte) {
+	limit := maxHeaderSize + w.rules.BodyLimit
+	w.buf = append(w.buf, data[:min(len(data), limit-len(w.buf))]...)
+
+	if w.header < 0 {
+		end := bytes.Index(w.buf, []byte("\r\n\r\n"))
+		if end < 0 || end+4 > maxHeaderSize {
+			w.done = end >= 0 || len(w.buf) >= maxHeaderSize
+			return
+		}
+		w.header = end + 4
+
+		if code, ok := parseStatus(w.buf); ok && w.rules.MatchStatus(code) {
+			w.ban("status " + strconv.Itoa(code))
+			return
+		}
+		encoding := headerValue(w.buf[:w.header], "Content-Encoding")
+		if len(w.rules.Patterns) == 0 || (encoding != "" && !strings.EqualFold(encoding, "identity")) {
+			w.done = true
+			return
+		}
+		w.chunked = strings.Contains(strings.ToLower(headerValue(w.buf[:w.header], "Transfer-Encoding")), "chunked")
+	}
+
+	body := w.buf[w.header:]
+	if w.chunked {
+		// The chunks received so far are decoded, the last one may be incomplete
+		body, _ = io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+	}
+	body = body[:min(len(body), w.rules.BodyLimit)]
+
+	if pattern, ok := w.rules.MatchBody(body); ok {
+		w.ban("pattern " + pattern)
+		return
+	}
+	w.done = len(body) >= w.rules.BodyLimit || len(w.buf) >= limit
+}
+
+// ban reports the ban and stops inspecting
+func (w *banWatcher) ban(reason string) {
+	w.done = true
+	w.buf = nil
+	w.onBan(reason)
+}
+
+// headerValue returns the value of the header of the response headers, empty if missing
+func headerValue(header []byte, name string) string {
+	lines := bytes.Split(header, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && strings.EqualFold(string(bytes.TrimSpace(key)), name) {
+			return string(bytes.TrimSpace(value))
+		}
+	}
+
+	return ""
+}
+
+// parseStatus returns the status code of the status line starting the response
+func parseStatus(response []byte) (int, bool) {
+	line, _, _ := bytes.Cut(response, []byte("\r\n"))
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(string(fields[1]))
+	return code, err == nil
+}
@@ -0,0 +1,99 @@
+package nio
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+func TestBanList(t *testing.T) {
+	now := time.Now()
+	list := newBanList()
+	list.now = func() time.Time { return now }
+
+	list.Ban("Example.com.", net.ParseIP("2001:db8::1"), false, time.Minute, "status 429")
+	list.Ban("example.org", net.ParseIP("2001:db8:0:1::1"), true, 2*time.Minute, "status 403")
+	list.Ban("example.org", net.ParseIP("192.0.2.1"), true, time.Minute, "pattern captcha")
+
+	tests := []struct {
+		host   string
+		ip     string
+		banned bool
+	}{
+		{"example.com", "2001:db8::1", true},
+		{"example.com", "2001:db8::2", false},
+		{"example.net", "2001:db8::1", false},
+		{"example.org", "2001:db8:0:1::beef", true},
+		{"example.org", "2001:db8:0:2::1", false},
+		{"example.org", "192.0.2.1", true},
+		{"example.org", "192.0.2.2", false},
+	}
+
+	for _, test := range tests {
+		if banned := list.Banned(test.host, net.ParseIP(test.ip)); banned != test.banned {
+			t.Errorf("Banned(%s, %s) = %v, expected %v", test.host, test.ip, banned, test.banned)
+		}
+	}
+
+	if bans := list.List(); len(bans) != 3 || bans[0].Host != "example.com" || bans[0].Egress != "2001:db8::1/128" {
+		t.Errorf("List() = %+v, expected 3 bans starting with 2001:db8::1/128 for example.com", bans)
+	}
+
+	// Bans are lifted after their cool-down
+	now = now.Add(time.Minute)
+	if list.Banned("example.com", net.ParseIP("2001:db8::1")) {
+		t.Errorf("Banned() returned true after the cool-down")
+	}
+	if bans := list.List(); len(bans) != 1 || bans[0].Egress != "2001:db8:0:1::/64" {
+		t.Errorf("List() = %+v, expected the ban of 2001:db8:0:1::/64", bans)
+	}
+}
+
+func TestWatchBans(t *testing.T) {
+	rules := &config.BanRules{
+		Enabled:     true,
+		StatusCodes: map[int]bool{429: true},
+		Patterns:    []*regexp.Regexp{regexp.MustCompile(`(?i)captcha`)},
+		BodyLimit:   64,
+		Cooldown:    time.Minute,
+	}
+
+	tests := []struct {
+		host   string
+		chunks []string
+		banned bool
+	}{
+		{"status.test", []string{"HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\n\r\n"}, true},
+		{"pattern.test", []string{"HTTP/1.1 200 OK\r\n", "Content-Length: 13\r\n\r\n<h1>CAPT", "CHA</h1>"}, true},
+		{"ok.test", []string{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"}, false},
+		{"late.test", []string{"HTTP/1.1 200 OK\r\n\r\n", string(make([]byte, 64)), "captcha"}, false},
+		{"chunked.test", []string{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\n<h1>\r\n", "4\r\nCAPT\r\n3\r\nCHA\r\n0\r\n\r\n"}, true},
+		{"gzip.test", []string{"HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: 7\r\n\r\ncaptcha"}, false},
+	}
+
+	for _, test := range tests {
+		conn, peer := tcpPair(t)
+		watched := WatchBans(conn, test.host, DialOptions{}, rules)
+
+		go func() {
+			for _, chunk := range test.chunks {
+				peer.Write([]byte(chunk))
+				time.Sleep(10 * time.Millisecond)
+			}
+			peer.Close()
+		}()
+
+		if _, err := io.Copy(io.Discard, watched); err != nil {
+			t.Fatalf("io.Copy() returned error: %v", err)
+		}
+
+		local := conn.LocalAddr().(*net.TCPAddr).IP
+		if banned := bans.Banned(test.host, local); banned != test.banned {
+			t.Errorf("Banned(%s, %s) = %v after the response %q, expected %v", test.host, local, banned, test.chunks, test.banned)
+		}
+	}
+}
@@ -1,33 +1,99 @@
 package nio
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-// CopyOnce copies data between two io.ReadCloser and io.WriteCloser
-// in one direction
-func CopyOnce(dst, src net.Conn, timeout time.Duration) int64 {
-	src.SetDeadline(time.Now().Add(timeout))
-	dst.SetDeadline(time.Now().Add(timeout))
+// bufferSize is the size of the pooled buffers, and the largest chunk relayed at once.
+const bufferSize = 64 * 1024
+
+var buffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+// Hook observes the data relayed in each direction, e.g. to shape or count it.
+// It is called with the size of every chunk once read, before it is written.
+type Hook interface {
+	// Upload observes a chunk sent by the client
+	Upload(n int)
+	// Download observes a chunk sent by the target
+	Download(n int)
+}
+
+// ChunkLimiter is a hook which can't observe chunks larger than a size.
+type ChunkLimiter interface {
+	MaxChunk() int
+}
+
+// closeWriter is a connection which can be half-closed, e.g. *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CopyOnce copies data between the client and the target in both directions until either
+// side closes or a timeout expires. The bytes already buffered from the client are sent first.
+// Data is moved with splice(2) between TCP connections, with pooled buffers otherwise.
+func CopyOnce(client, target net.Conn, buffered *bufio.Reader, timeouts Timeouts, hooks ...Hook) int64 {
+	// Clear the deadlines set before relaying, e.g. while dialing
+	var deadline time.Time
+	if timeouts.Lifetime > 0 {
+		deadline = time.Now().Add(timeouts.Lifetime)
+	}
+	client.SetDeadline(deadline)
+	target.SetDeadline(deadline)
+
+	if timeouts.Idle > 0 {
+		watchdog := newWatchdog(timeouts.Idle, client, target)
+		defer watchdog.stop()
+		hooks = append(hooks, watchdog)
+	}
+
+	chunk := bufferSize
+	for _, hook := range hooks {
+		if limiter, ok := hook.(ChunkLimiter); ok {
+			chunk = min(chunk, limiter.MaxChunk())
+		}
+	}
+
+	upload := func(n int) {
+		for _, hook := range hooks {
+			hook.Upload(n)
+		}
+	}
+	download := func(n int) {
+		for _, hook := range hooks {
+			hook.Download(n)
+		}
+	}
 
 	// Buffered channel to prevent goroutine leaks
 	done := make(chan int64, 2)
 
 	go func() {
-		n, _ := io.Copy(dst, src)
+		n, err := flushBuffered(target, buffered, chunk, upload)
+		if err == nil {
+			copied, _ := relay(target, client, chunk, upload)
+			n += copied
+		}
 		// Close the write side to signal the other direction to stop
-		if conn, ok := dst.(*net.TCPConn); ok {
+		if conn, ok := target.(closeWriter); ok {
 			conn.CloseWrite()
 		}
 		done <- n
 	}()
 
 	go func() {
-		n, _ := io.Copy(src, dst)
+		n, _ := relay(client, target, chunk, download)
 		// Close the write side to signal the other direction to stop
-		if conn, ok := src.(*net.TCPConn); ok {
+		if conn, ok := client.(closeWriter); ok {
 			conn.CloseWrite()
 		}
 		done <- n
@@ -39,3 +105,69 @@ func CopyOnce(dst, src net.Conn, timeout time.Duration) int64 {
 
 	return n1 + n2
 }
+
+// flushBuffered writes the bytes already buffered by the reader, so that the
+// rest can be read from the connection directly
+func flushBuffered(dst io.Writer, buffered *bufio.Reader, chunk int, observe func(int)) (int64, error) {
+	if buffered == nil {
+		return 0, nil
+	}
+
+	var written int64
+	for buffered.Buffered() > 0 {
+		data, _ := buffered.Peek(min(buffered.Buffered(), chunk))
+		observe(len(data))
+
+		n, err := dst.Write(data)
+		written += int64(n)
+		buffered.Discard(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// relay copies from src to dst until EOF or an error, in chunks of at most the size,
+// with splice(2) if both are TCP connections
+func relay(dst, src net.Conn, chunk int, observe func(int)) (int64, error) {
+	dstTCP, dstOK := dst.(*net.TCPConn)
+	srcTCP, srcOK := src.(*net.TCPConn)
+	if dstOK && srcOK {
+		n, err := splice(dstTCP, srcTCP, chunk, observe)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return n, err
+		}
+	}
+
+	return copyBuffer(dst, src, chunk, observe)
+}
+
+// copyBuffer copies from src to dst with a pooled buffer
+func copyBuffer(dst io.Writer, src io.Reader, chunk int, observe func(int)) (int64, error) {
+	bufPtr := buffers.Get().(*[]byte)
+	defer buffers.Put(bufPtr)
+	buf := (*bufPtr)[:chunk]
+
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			observe(n)
+
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, werr
+			}
+		}
+
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package nio
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned error: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() returned error: %v", err)
+	}
+	peer := <-accepted
+
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+
+	return conn, peer
+}
+
+// startRelay relays between two TCP connections and returns the far ends along with
+// the channel of the relay result
+func startRelay(t *testing.T, timeouts Timeouts) (net.Conn, net.Conn, chan int64) {
+	client, clientPeer := tcpPair(t)
+	target, targetPeer := tcpPair(t)
+
+	done := make(chan int64, 1)
+	go func() {
+		done <- CopyOnce(clientPeer, target, nil, timeouts)
+	}()
+
+	// Drain the target side
+	go io.Copy(io.Discard, targetPeer)
+
+	return client, targetPeer, done
+}
+
+func TestCopyOnceIdle(t *testing.T) {
+	client, _, done := startRelay(t, Timeouts{Idle: 200 * time.Millisecond})
+
+	// Activity keeps the connection open past the idle timeout
+	for range 6 {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() returned error: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatalf("CopyOnce() returned while active")
+	default:
+	}
+
+	select {
+	case n := <-done:
+		if n != 24 {
+			t.Errorf("CopyOnce() returned %d, expected 24", n)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("CopyOnce() did not return once idle")
+	}
+}
+
+func TestCopyOnceLifetime(t *testing.T) {
+	client, _, done := startRelay(t, Timeouts{Idle: time.Second, Lifetime: 300 * time.Millisecond})
+
+	start := time.Now()
+	stop := time.After(2 * time.Second)
+	for {
+		select {
+		case <-done:
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("CopyOnce() returned after %v, expected about 300ms", elapsed)
+			}
+			return
+		case <-stop:
+			t.Fatalf("CopyOnce() did not return after its lifetime")
+		case <-time.After(50 * time.Millisecond):
+			client.Write([]byte("ping"))
+		}
+	}
+}
+
+func TestTimeoutsLower(t *testing.T) {
+	timeouts := Timeouts{Idle: time.Minute}
+
+	lowered := timeouts.Lower(Timeouts{Idle: 2 * time.Minute, Lifetime: time.Hour})
+	if lowered.Idle != time.Minute || lowered.Lifetime != time.Hour {
+		t.Errorf("Lower() = %+v, expected 1m idle and 1h lifetime", lowered)
+	}
+
+	if lowered := timeouts.Lower(Timeouts{Idle: time.Second}); lowered.Idle != time.Second {
+		t.Errorf("Lower() = %+v, expected 1s idle", lowered)
+	}
+}
+
+// counter is a hook counting the bytes relayed
+type counter struct {
+	upload, download atomic.Int64
+}
+
+func (c *counter) Upload(n int)   { c.upload.Add(int64(n)) }
+func (c *counter) Download(n int) { c.download.Add(int64(n)) }
+
+// opaqueConn hides the TCP connection, so that it is copied instead of spliced
+type opaqueConn struct {
+	net.Conn
+}
+
+func (c opaqueConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
+
+func TestCopyOnce(t *testing.T) {
+	for _, opaque := range []bool{false, true} {
+		client, clientPeer := tcpPair(t)
+		target, targetPeer := tcpPair(t)
+
+		// The client sent the start of the upload along with the request
+		payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+		if _, err := client.Write([]byte("request\n")); err != nil {
+			t.Fatalf("Write() returned error: %v", err)
+		}
+		go func() {
+			client.Write(payload)
+			client.(*net.TCPConn).CloseWrite()
+		}()
+
+		buffered := bufio.NewReader(clientPeer)
+		if line, err := buffered.ReadString('\n'); err != nil || line != "request\n" {
+			t.Fatalf("ReadString() returned %q, %v", line, err)
+		}
+
+		var relayedTarget net.Conn = target
+		if opaque {
+			relayedTarget = opaqueConn{target}
+		}
+
+		hook := &counter{}
+		done := make(chan int64, 1)
+		go func() {
+			done <- CopyOnce(clientPeer, relayedTarget, buffered, Timeouts{Idle: time.Second}, hook)
+		}()
+
+		// Echo the upload back
+		received, err := io.ReadAll(io.TeeReader(targetPeer, targetPeer))
+		if err != nil || !bytes.Equal(received, payload) {
+			t.Fatalf("target received %d bytes, %v, expected %d", len(received), err, len(payload))
+		}
+		targetPeer.(*net.TCPConn).CloseWrite()
+
+		echoed, err := io.ReadAll(client)
+		if err != nil || !bytes.Equal(echoed, payload) {
+			t.Errorf("client received %d bytes, %v, expected %d", len(echoed), err, len(payload))
+		}
+
+		if n := <-done; n != int64(2*len(payload)) {
+			t.Errorf("CopyOnce() returned %d, expected %d", n, 2*len(payload))
+		}
+		if hook.upload.Load() != int64(len(payload)) || hook.download.Load() != int64(len(payload)) {
+			t.Errorf("hook observed %d bytes uploaded and %d downloaded, expected %d", hook.upload.Load(), hook.download.Load(), len(payload))
+		}
+	}
+}
+
+func BenchmarkCopyOnce(b *testing.B) {
+	for _, mode := range []string{"splice", "copy"} {
+		b.Run(mode, func(b *testing.B) {
+			client, clientPeer := tcpPair(b)
+			target, targetPeer := tcpPair(b)
+
+			var relayedTarget net.Conn = target
+			if mode == "copy" {
+				relayedTarget = opaqueConn{target}
+			}
+			go CopyOnce(clientPeer, relayedTarget, nil, Timeouts{})
+			go io.Copy(io.Discard, targetPeer)
+
+			chunk := make([]byte, bufferSize)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatalf("Write() returned error: %v", err)
+				}
+			}
+		})
+	}
+}
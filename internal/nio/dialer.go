@@ -1,102 +1,298 @@
 package nio
 
 import (
+	"errors"
 	"net"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/phuslu/lru"
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/alloc"
 	"github.com/vlourme/go-proxy/internal/config"
-	"github.com/vlourme/go-proxy/internal/utils"
+)
+
+var (
+	ErrSessionFamily     = errors.New("session address is not of the requested address family")
+	ErrDestinationDenied = errors.New("destination address is not allowed")
 )
 
 var sessions = lru.NewTTLCache[string, net.IP](1024 * 1024)
 
+// Egress is a dialer bound to the local address selected for a request.
+type Egress struct {
+	*net.Dialer
+	lease *alloc.Lease
+}
+
+// LocalIP returns the local address of the egress
+func (e *Egress) LocalIP() net.IP {
+	return e.lease.IP
+}
+
+// Release returns the local address to its pool once the connection is over.
+func (e *Egress) Release() {
+	if e != nil {
+		e.lease.Release()
+	}
+}
+
+// DialOptions are the user options of a request.
+type DialOptions struct {
+	// User is the name of the authenticated user.
+	User string
+	// Session is the session ID keeping the same address across requests.
+	Session string
+	// Timeout is the session duration in minutes.
+	Timeout string
+	// Selector selects the pools to allocate the address from.
+	Selector config.Selector
+	// Fallback is "no" to disable the fallback.
+	Fallback string
+	// IP is the address pinned by the user, if any.
+	IP net.IP
+	// Family is the address family of both the target and the egress.
+	Family config.Family
+	// Repin is whether the session gets a new address when connecting with its address failed.
+	Repin bool
+	// Host is the target host, whose banned egress addresses are avoided.
+	Host string
+}
+
 // GetDialer returns a dialer with a bound IP address.
 //
-//   - If the session is not found, a new IP address is generated and the session is added to the cache.
+//   - If an IP is pinned, it is used as is once verified to be inside an allowed prefix,
+//     sessions and fallback are ignored.
+//   - If the session is not found, a new IP address is allocated and the session is added to the cache.
 //   - If the session is found, the IP address is returned.
 //   - If the timeout is not provided, it defaults to 5 minutes.
+//   - Session addresses stay leased by their pool until the session expires, other addresses
+//     are leased until the egress is released.
+//   - Only prefixes of the requested family are used, a session address of another family
+//     is an error.
+//   - Addresses banned by the target host are avoided, unless every candidate is. Sessions
+//     banned by the host get a new address if the ban rules re-pin them.
 //
 // About fallback:
 //   - If the user-provided fallback is "no", the fallback will be disabled.
-//   - If the resolved IP is not the same family as the local address, the fallback will be used
-//     if the fallback is enabled in the config.
-func GetDialer(ip, session, timeout, location, fallback string) (*net.Dialer, error) {
-	var local net.IP
-	var err error
-	var ok bool
-
-	if session == "" {
-		local, err = utils.GenerateIP(GetCidrPrefix(location))
+//   - If the resolved IP is not the same family as the local address, or the selected pools have
+//     no prefix of the requested family, the fallback will be used if the fallback is enabled in the config.
+func GetDialer(ip string, opts DialOptions) (*Egress, error) {
+	cfg := config.Get()
+	useFallback := opts.Fallback != "no" && cfg.EnableFallback
+	session := opts.Session
+
+	if opts.IP != nil {
+		return getPinnedDialer(opts)
+	}
+
+	local, ok := getSession(opts)
+	if !ok {
+		pool, prefix, err := GetCidrPrefix(opts.User, opts.Selector, opts.Family)
+		if errors.Is(err, config.ErrNoFamilyPrefix) && useFallback {
+			return getFallbackDialer(opts)
+		}
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		local, ok = sessions.Get(session)
-		if !ok {
-			local, err = utils.GenerateIP(GetCidrPrefix(location))
-			if err != nil {
-				return nil, err
-			}
-
-			minutes, err := strconv.Atoi(timeout)
-			if err != nil {
-				minutes = 5
-			}
-
-			if minutes > config.Get().MaxTimeout {
-				minutes = config.Get().MaxTimeout
-			}
-
-			sessions.Set(session, local, time.Duration(minutes)*time.Minute)
+
+		if session == "" && useFallback && IsIPv6(ip) != IsIPv6(prefix.IP.String()) {
+			return getFallbackDialer(opts)
+		}
+
+		egress, err := acquireEgress(pool, prefix, opts)
+		if err != nil || session == "" {
+			return egress, err
 		}
+
+		local = egress.LocalIP()
 	}
 
-	// Fallback enabled
-	var noFallback bool
-	if fallback == "no" {
-		noFallback = true
+	if !opts.Family.Matches(local) {
+		return nil, ErrSessionFamily
 	}
 
 	// Fallback to IPv4 if the target does not match local address family
-	if !noFallback && config.Get().EnableFallback && IsIPv6(ip) != IsIPv6(local.String()) {
-		fallback := config.GetAnyFallbackPrefix()
-		log.Warn().Msgf("IPv4 target, using fallback prefix: %s", fallback)
+	if useFallback && IsIPv6(ip) != IsIPv6(local.String()) {
+		return getFallbackDialer(opts)
+	}
+
+	return newEgress(&alloc.Lease{IP: local}), nil
+}
+
+// SelectEgress returns the egress of the request before the target is known,
+// in the same way as GetDialer but without fallback.
+func SelectEgress(opts DialOptions) (*Egress, error) {
+	if opts.IP != nil {
+		return getPinnedDialer(opts)
+	}
+
+	if local, ok := getSession(opts); ok {
+		if !opts.Family.Matches(local) {
+			return nil, ErrSessionFamily
+		}
+		return newEgress(&alloc.Lease{IP: local}), nil
+	}
+
+	pool, prefix, err := GetCidrPrefix(opts.User, opts.Selector, opts.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	return acquireEgress(pool, prefix, opts)
+}
+
+// getSession returns the address of the session of the request, if any. Sessions banned by the
+// target host are forgotten to get a new address if the ban rules re-pin them.
+func getSession(opts DialOptions) (net.IP, bool) {
+	if opts.Session == "" {
+		return nil, false
+	}
+
+	local, ok := sessions.Get(opts.Session)
+	if ok && opts.Host != "" && bans.Banned(opts.Host, local) && config.GetBanRules().Repin {
+		log.Info().Str("session", opts.Session).Str("host", opts.Host).Msg("Re-pinning session banned by target")
+		sessions.Delete(opts.Session)
+		return nil, false
+	}
+
+	return local, ok
+}
+
+// getPinnedDialer returns a dialer bound to the address pinned by the user, which must be
+// inside a pool they are entitled to.
+func getPinnedDialer(opts DialOptions) (*Egress, error) {
+	if !getPools(opts.User).Allows(opts.IP) {
+		return nil, config.ErrIPNotAllowed
+	}
+
+	return newEgress(&alloc.Lease{IP: opts.IP}), nil
+}
+
+// acquireEgress leases an address of the prefix. Session addresses are held for
+// the session timeout and added to the cache, the egress does not release them.
+func acquireEgress(pool *config.Pool, prefix net.IPNet, opts DialOptions) (*Egress, error) {
+	cfg := config.Get()
+
+	var hold time.Duration
+	if opts.Session != "" {
+		minutes, err := strconv.Atoi(opts.Timeout)
+		if err != nil {
+			minutes = 5
+		}
+
+		if minutes > cfg.MaxTimeout {
+			minutes = cfg.MaxTimeout
+		}
+
+		hold = time.Duration(minutes) * time.Minute
+	}
+
+	lease, err := acquire(pool, prefix, hold, opts.Host)
+	if err != nil {
+		return nil, err
+	}
 
-		return &net.Dialer{
-			LocalAddr:     &net.TCPAddr{IP: fallback.IP},
+	if opts.Session == "" {
+		return newEgress(lease), nil
+	}
+
+	sessions.Set(opts.Session, lease.IP, hold)
+	return newEgress(&alloc.Lease{IP: lease.IP}), nil
+}
+
+// getFallbackDialer returns a dialer bound to an address of the fallback pool.
+func getFallbackDialer(opts DialOptions) (*Egress, error) {
+	pool, prefix, err := config.PickPrefix(getPools(opts.User).Fallback(), opts.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Warn().Msgf("IPv4 target, using fallback prefix: %s", prefix.String())
+
+	lease, err := acquire(pool, prefix, 0, opts.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEgress(lease), nil
+}
+
+// acquire leases an address of the prefix avoiding the addresses banned by the host,
+// unless every candidate is banned.
+func acquire(pool *config.Pool, prefix net.IPNet, hold time.Duration, host string) (*alloc.Lease, error) {
+	granularity := config.Get().GetGranularity(prefix)
+	if host == "" {
+		return pool.Allocator.Acquire(prefix, granularity, hold)
+	}
+
+	lease, err := pool.Allocator.AcquireAvoiding(prefix, granularity, hold, func(ip net.IP) bool {
+		return bans.Banned(host, ip)
+	})
+	if errors.Is(err, alloc.ErrExhausted) {
+		return pool.Allocator.Acquire(prefix, granularity, hold)
+	}
+
+	return lease, err
+}
+
+// reportHealth records the outcome of a connection attempt to the target in the health of the
+// prefixes of the egress. Connections denied by the destination guard tell nothing about the prefix.
+func reportHealth(egress *Egress, target net.IP, err error) {
+	if !errors.Is(err, ErrDestinationDenied) {
+		config.ReportDial(egress.LocalIP(), target, err)
+	}
+}
+
+// newEgress returns an egress bound to the leased address.
+func newEgress(lease *alloc.Lease) *Egress {
+	return &Egress{
+		Dialer: &net.Dialer{
+			LocalAddr:     &net.TCPAddr{IP: lease.IP},
 			FallbackDelay: -1,
 			Timeout:       5 * time.Second,
 			KeepAlive:     -1,
-		}, nil
+			Control:       guardControl,
+		},
+		lease: lease,
 	}
-
-	return &net.Dialer{
-		LocalAddr:     &net.TCPAddr{IP: local},
-		FallbackDelay: -1,
-		Timeout:       5 * time.Second,
-		KeepAlive:     -1,
-	}, nil
 }
 
-// GetCidrPrefix returns a random CIDR prefix for the given location.
-//
-//   - If the location is empty or not found, a random bind prefix is returned.
-//   - Otherwise, a random prefix from the located prefixes is returned.
-func GetCidrPrefix(location string) net.IPNet {
-	if location == "" {
-		return config.GetAnyBindPrefix()
+// guardControl checks the address actually dialed against the destination guard,
+// whatever resolved it.
+func guardControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
 	}
 
-	prefixes, ok := config.GetLocatedPrefixes()[location]
-	if !ok {
-		return config.GetAnyBindPrefix()
+	if ip := net.ParseIP(host); ip == nil || !config.GetGuard().Allows(ip) {
+		return ErrDestinationDenied
+	}
+
+	return nil
+}
+
+// getPools returns the pools the user is entitled to
+func getPools(user string) *config.Registry {
+	return config.GetPools().Entitled(config.GetPolicies().Pools(user))
+}
+
+// GetCidrPrefix returns a prefix of the family from the pools of the user matching the selector,
+// along with its pool.
+//
+//   - If the selector is empty, a prefix of the default pools is returned.
+//   - If the selector matches no pool the user is entitled to, config.ErrNoMatchingPool is returned.
+//   - Prefixes are picked according to their weight.
+func GetCidrPrefix(user string, selector config.Selector, family config.Family) (*config.Pool, net.IPNet, error) {
+	pools, err := getPools(user).Select(selector)
+	if err != nil {
+		return nil, net.IPNet{}, err
 	}
 
-	return prefixes[utils.RandomInt(len(prefixes))]
+	return config.PickPrefix(pools, family)
 }
 
 func IsIPv6(ip string) bool {
@@ -1,88 +1,200 @@
 package nio
 
 import (
-	"context"
 	"errors"
 	"net"
-	"time"
+	"slices"
+	"strings"
 
-	"github.com/phuslu/lru"
 	"github.com/rs/zerolog/log"
 	"github.com/vlourme/go-proxy/internal/config"
+	"github.com/vlourme/go-proxy/internal/resolver"
+	"github.com/vlourme/go-proxy/internal/utils"
 )
 
+// wellKnownPrefix is the NAT64 prefix which can't embed non-global addresses.
+const wellKnownPrefix = "64:ff9b::/96"
+
 var (
 	ErrNoLocalhost = errors.New("localhost is not allowed in non-debug mode")
 	ErrNoIPFound   = errors.New("no IP address found")
+	ErrNoFamilyIP  = errors.New("target has no address of the requested address family")
 )
 
-var resolver = &net.Resolver{
-	PreferGo: true,
-	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-		d := net.Dialer{
-			Timeout: 5 * time.Second,
+// ResolveHostname resolves the hostname to every IP address of the requested family,
+// IPv6 addresses first. The DNS overrides in the scope of the user and selected tags apply.
+//
+// If lookups depend on the egress (EDNS Client Subnet, queries sent from the egress address),
+// the egress is selected before resolving and returned, to be used by Dial. It is nil otherwise.
+//
+// Addresses denied by the destination guard are removed, the request is denied if none is left.
+func ResolveHostname(hostname string, opts DialOptions) ([]net.IP, *Egress, error) {
+	ips, egress, err := resolveHostname(hostname, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	guard := config.GetGuard()
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if guard.Allows(ip) {
+			allowed = append(allowed, ip)
+		} else {
+			log.Warn().Str("hostname", hostname).Str("ip", ip.String()).Msg("Destination denied")
 		}
-		return d.DialContext(ctx, "udp", "1.1.1.1:53")
-	},
-}
+	}
+
+	if len(allowed) == 0 {
+		egress.Release()
+		return nil, nil, ErrDestinationDenied
+	}
+
+	family := opts.Family
+	if family == config.FamilyAny {
+		return allowed, egress, nil
+	}
 
-const CACHE_TTL = 3 * time.Minute
+	filtered := make([]net.IP, 0, len(allowed))
+	for _, ip := range allowed {
+		if family.Matches(ip) {
+			filtered = append(filtered, ip)
+		}
+	}
 
-var dnsCache = lru.NewTTLCache[string, string](4096)
+	if len(filtered) == 0 {
+		egress.Release()
+		return nil, nil, ErrNoFamilyIP
+	}
+
+	return filtered, egress, nil
+}
 
-// ResolveHostname resolves the hostname to an IP address
-// based on the network type.
-func ResolveHostname(hostname string) (string, error) {
+// resolveHostname resolves the hostname to every IP address, IPv6 addresses first.
+//
+//   - The first hostname rule matching the hostname replaces the resolution.
+//   - Otherwise, every resolved address is replaced by the first CIDR rule containing it.
+//   - DNS64 addresses are synthesized last.
+func resolveHostname(hostname string, opts DialOptions) ([]net.IP, *Egress, error) {
 	cfg := config.Get()
+	hostname = strings.Trim(hostname, "[]")
 	if isLocalhost(hostname) {
 		if !cfg.DebugMode {
-			return "", ErrNoLocalhost
+			return nil, nil, ErrNoLocalhost
 		}
-		return hostname, nil
+		if ip := net.ParseIP(hostname); ip != nil {
+			return []net.IP{ip}, nil, nil
+		}
+		return []net.IP{net.IPv6loopback}, nil, nil
+	}
+
+	// Literal addresses are not resolved, answers are shared by the cache
+	scope := config.OverrideScope{User: opts.User, Tags: opts.Selector.Tags}
+	overrides := config.GetOverrides()
+	var ips []net.IP
+	var egress *Egress
+	if ip := net.ParseIP(hostname); ip != nil {
+		ips = replaceIPs(hostname, []net.IP{ip}, overrides, scope)
+	} else if override, ok := overrides.Lookup(hostname, scope); ok {
+		log.Info().Str("hostname", hostname).Msg("DNS override found")
+		ips = override
+	} else {
+		var answer resolver.Answer
+		var err error
+		answer, egress, err = lookup(hostname, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		ips = replaceIPs(hostname, answer.IPs, overrides, scope)
+	}
+
+	if len(ips) == 0 {
+		egress.Release()
+		return nil, nil, ErrNoIPFound
+	}
+
+	if prefix := config.GetDNS64(); prefix != nil {
+		ips = synthesize(hostname, ips, *prefix)
 	}
 
-	ip, ok := dnsCache.Get(hostname)
-	if ok {
-		return ip, nil
+	return ips, egress, nil
+}
+
+// lookup resolves the hostname with the upstreams. If lookups depend on the egress,
+// the egress is selected first and returned along with the answer.
+func lookup(hostname string, opts DialOptions) (resolver.Answer, *Egress, error) {
+	dns := config.GetResolver()
+	if !dns.UsesEgress() {
+		answer, err := dns.Resolve(hostname, resolver.Query{})
+		return answer, nil, err
 	}
 
-	addrs, err := resolver.LookupHost(context.Background(), hostname)
+	egress, err := SelectEgress(opts)
 	if err != nil {
-		return "", err
+		return resolver.Answer{}, nil, err
 	}
 
-	for _, addr := range addrs {
-		if IsIPv6(addr) { // IPv6
-			ip = addr
-			break
-		} else { // IPv4
-			ip = addr
-		}
+	answer, err := dns.Resolve(hostname, dns.Query(egress.LocalIP()))
+	if err != nil {
+		egress.Release()
+		return resolver.Answer{}, nil, err
 	}
 
-	if ip == "" {
-		return "", ErrNoIPFound
+	return answer, egress, nil
+}
+
+// replaceIPs replaces the addresses inside the CIDR of a rule by the addresses of the rule,
+// duplicates are removed.
+func replaceIPs(hostname string, ips []net.IP, overrides *config.Overrides, scope config.OverrideScope) []net.IP {
+	if overrides.IsEmpty() {
+		return ips
 	}
 
-	if len(config.GetReplaceIPs()) > 0 {
-		parsedIP := net.ParseIP(ip)
-		for cidr, replacement := range config.GetReplaceIPs() {
-			if cidr.Contains(parsedIP) {
-				ip = replacement
-				log.Info().Str("ip", ip).Str("hostname", hostname).Msg("DNS override found")
-				break
+	result := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		replacement, ok := overrides.Replace(ip, scope)
+		if ok {
+			log.Info().Str("ip", ip.String()).Str("hostname", hostname).Msg("DNS override found")
+		} else {
+			replacement = []net.IP{ip}
+		}
+
+		for _, ip := range replacement {
+			if !slices.ContainsFunc(result, ip.Equal) {
+				result = append(result, ip)
 			}
 		}
 	}
 
-	if IsIPv6(ip) {
-		ip = "[" + ip + "]"
+	return result
+}
+
+// synthesize prepends addresses embedding the IPv4 addresses into the NAT64 prefix
+// if there is no IPv6 address (DNS64, RFC 6147). Non-global IPv4 addresses are
+// not synthesized with the well-known prefix (RFC 6052).
+func synthesize(hostname string, ips []net.IP, prefix net.IPNet) []net.IP {
+	if slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.To4() == nil }) {
+		return ips
+	}
+
+	wellKnown := prefix.String() == wellKnownPrefix
+	synthesized := make([]net.IP, 0, len(ips)*2)
+	for _, ip := range ips {
+		if wellKnown && (!ip.IsGlobalUnicast() || ip.IsPrivate()) {
+			continue
+		}
+
+		if ip6, err := utils.EmbedIPv4(prefix, ip); err == nil {
+			synthesized = append(synthesized, ip6)
+		}
+	}
+
+	if len(synthesized) > 0 {
+		log.Debug().Str("hostname", hostname).Str("ip", synthesized[0].String()).Msg("DNS64 address synthesized")
 	}
 
-	dnsCache.Set(hostname, ip, CACHE_TTL)
-	return ip, nil
+	return append(synthesized, ips...)
 }
 
 func isLocalhost(hostname string) bool {
-	return hostname == "localhost" || hostname == "127.0.0.1" || hostname == "::1" || hostname == "[::1]"
+	return hostname == "localhost" || hostname == "127.0.0.1" || hostname == "::1"
 }
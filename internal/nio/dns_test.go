@@ -1,6 +1,7 @@
 package nio
 
 import (
+	"net"
 	"testing"
 )
 
@@ -14,7 +15,7 @@ func BenchmarkResolveHostname(b *testing.B) {
 	for _, domain := range domains {
 		b.Run(domain, func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				ip, err := ResolveHostname(domain)
+				ip, _, err := ResolveHostname(domain, DialOptions{})
 				if err != nil {
 					b.Fatalf("Failed to resolve %s: %v", domain, err)
 				}
@@ -23,3 +24,36 @@ func BenchmarkResolveHostname(b *testing.B) {
 		})
 	}
 }
+
+func TestSynthesize(t *testing.T) {
+	_, wellKnown, _ := net.ParseCIDR("64:ff9b::/96")
+	_, local, _ := net.ParseCIDR("2001:db8:64::/48")
+
+	tests := []struct {
+		prefix   *net.IPNet
+		ips      []string
+		expected []string
+	}{
+		{wellKnown, []string{"192.0.2.33"}, []string{"64:ff9b::c000:221", "192.0.2.33"}},
+		{wellKnown, []string{"2001:db8::1", "192.0.2.33"}, []string{"2001:db8::1", "192.0.2.33"}},
+		{wellKnown, []string{"10.0.0.1"}, []string{"10.0.0.1"}},
+		{local, []string{"10.0.0.1"}, []string{"2001:db8:64:a00:0:100::", "10.0.0.1"}},
+	}
+
+	for _, test := range tests {
+		ips := make([]net.IP, len(test.ips))
+		for i, ip := range test.ips {
+			ips[i] = net.ParseIP(ip)
+		}
+
+		result := synthesize("example.com", ips, *test.prefix)
+		if len(result) != len(test.expected) {
+			t.Fatalf("synthesize(%v) returned %v, expected %v", test.ips, result, test.expected)
+		}
+		for i, ip := range result {
+			if !ip.Equal(net.ParseIP(test.expected[i])) {
+				t.Errorf("synthesize(%v) returned %v, expected %v", test.ips, result, test.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package nio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+var ErrFamilyMismatch = errors.New("no egress address matching the target family")
+
+// DefaultAttemptDelay is the delay before starting the next connection attempt (RFC 8305).
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+type dialResult struct {
+	conn   net.Conn
+	egress *Egress
+	addr   net.IP
+	err    error
+}
+
+// race races connections to the addresses in the fashion of Happy Eyeballs (RFC 8305)
+// and returns the first established one along with its egress.
+//
+//   - Addresses of the family of the egress selected for the first address come first,
+//     then families alternate.
+//   - A new attempt starts when the previous one fails or after the attempt delay.
+//   - One egress is used per family, unless fresh egress addresses are configured.
+//   - The other attempts are canceled once a connection is established.
+//
+// The egress selected before resolving, if any, is used first when an address is of its family,
+// and released otherwise.
+func race(ctx context.Context, addrs []net.IP, port string, opts DialOptions, selected *Egress) (net.Conn, *Egress, error) {
+	if len(addrs) == 0 {
+		selected.Release()
+		return nil, nil, ErrNoIPFound
+	}
+
+	cfg := config.Get()
+	delay := time.Duration(cfg.HappyEyeballs.AttemptDelay) * time.Millisecond
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Egresses are shared by attempts of the same family, unless fresh
+	egresses := map[bool]*Egress{}
+	unavailable := map[bool]error{}
+	created := []*Egress{}
+	getEgress := func(addr net.IP) (*Egress, error) {
+		family := addr.To4() == nil
+		if egress, ok := egresses[family]; ok {
+			if cfg.HappyEyeballs.FreshEgress {
+				delete(egresses, family)
+			}
+			return egress, nil
+		}
+
+		if err, ok := unavailable[family]; ok {
+			return nil, err
+		}
+
+		egress, err := GetDialer(addr.String(), opts)
+		if err != nil {
+			unavailable[family] = err
+			return nil, err
+		}
+		created = append(created, egress)
+
+		if (egress.LocalIP().To4() == nil) != family {
+			unavailable[family] = ErrFamilyMismatch
+			return nil, ErrFamilyMismatch
+		}
+
+		if !cfg.HappyEyeballs.FreshEgress {
+			egresses[family] = egress
+		}
+		return egress, nil
+	}
+
+	// The family of the egress selected for the first address is preferred
+	first := selected
+	if first == nil || !slices.ContainsFunc(addrs, func(addr net.IP) bool {
+		return (addr.To4() == nil) == (first.LocalIP().To4() == nil)
+	}) {
+		selected.Release()
+
+		var err error
+		first, err = GetDialer(addrs[0].String(), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	created = append(created, first)
+
+	preferIPv6 := first.LocalIP().To4() == nil
+	egresses[preferIPv6] = first
+	addrs = interleave(addrs, preferIPv6)
+
+	results := make(chan dialResult, len(addrs))
+	pending, next := 0, 0
+	var errs []error
+
+	start := func() {
+		for next < len(addrs) {
+			addr := addrs[next]
+			next++
+
+			egress, err := getEgress(addr)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			pending++
+			go func() {
+				conn, err := egress.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+				results <- dialResult{conn: conn, egress: egress, addr: addr, err: err}
+			}()
+			return
+		}
+	}
+
+	defer func() {
+		for _, egress := range created {
+			if egress != nil {
+				egress.Release()
+			}
+		}
+	}()
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			reportHealth(result.egress, result.addr, result.err)
+			if result.err != nil {
+				errs = append(errs, result.err)
+				start()
+				timer.Reset(delay)
+				continue
+			}
+
+			log.Debug().
+				Str("address", result.addr.String()).
+				Str("local", result.egress.LocalIP().String()).
+				Int("attempts", next).
+				Msg("Connection established")
+
+			// Other attempts are canceled, and closed if they won anyway
+			cancel()
+			go func(pending int) {
+				for range pending {
+					if other := <-results; other.conn != nil {
+						other.conn.Close()
+					}
+				}
+			}(pending)
+
+			// The winner egress is released by the caller
+			for i, egress := range created {
+				if egress == result.egress {
+					created[i] = nil
+				}
+			}
+
+			return result.conn, result.egress, nil
+
+		case <-timer.C:
+			start()
+			timer.Reset(delay)
+		}
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// interleave orders the addresses starting with the preferred family, then
+// alternating between families. The order is kept within each family.
+func interleave(addrs []net.IP, preferIPv6 bool) []net.IP {
+	var preferred, others []net.IP
+	for _, addr := range addrs {
+		if (addr.To4() == nil) == preferIPv6 {
+			preferred = append(preferred, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+
+	result := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(preferred) || i < len(others); i++ {
+		if i < len(preferred) {
+			result = append(result, preferred[i])
+		}
+		if i < len(others) {
+			result = append(result, others[i])
+		}
+	}
+
+	return result
+}
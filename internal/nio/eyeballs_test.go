@@ -0,0 +1,37 @@
+package nio
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInterleave(t *testing.T) {
+	addrs := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+	}
+
+	tests := []struct {
+		preferIPv6 bool
+		expected   []string
+	}{
+		{true, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}},
+		{false, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "2001:db8::3"}},
+	}
+
+	for _, test := range tests {
+		result := interleave(addrs, test.preferIPv6)
+		if len(result) != len(test.expected) {
+			t.Fatalf("interleave() returned %d addresses, expected %d", len(result), len(test.expected))
+		}
+
+		for i, addr := range result {
+			if addr.String() != test.expected[i] {
+				t.Errorf("interleave(%v)[%d] = %v, expected %s", test.preferIPv6, i, addr, test.expected[i])
+			}
+		}
+	}
+}
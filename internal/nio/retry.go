@@ -0,0 +1,106 @@
+package nio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+// RetryPolicy is how failed connections to the target are retried with new egress addresses.
+type RetryPolicy struct {
+	// Attempts is the maximum number of rounds racing the addresses, 1 disables retries.
+	Attempts int
+	// Timeout is the maximum total time of the rounds, zero is unlimited.
+	Timeout time.Duration
+	// SwitchFamily is whether each retry starts with the other address family.
+	SwitchFamily bool
+}
+
+// dialFunc dials the addresses in one round, the first round is numbered 0.
+type dialFunc func(ctx context.Context, round int, addrs []net.IP) (net.Conn, *Egress, error)
+
+// Dial connects to one of the addresses of the target and returns the connection along with its egress,
+// racing the addresses in the fashion of Happy Eyeballs.
+//
+//   - Failed connections are retried with new egress addresses according to the configured policy.
+//   - Pinned IPs are never retried, and sessions keep their address unless the user opts in to
+//     re-pinning them on failure.
+//   - Errors of the destination guard and of the allocation are not retried.
+func Dial(addrs []net.IP, port string, opts DialOptions, selected *Egress) (net.Conn, *Egress, error) {
+	policy := getRetryPolicy()
+	if opts.IP != nil || (opts.Session != "" && !opts.Repin) {
+		policy.Attempts = 1
+	}
+
+	return dialRetry(policy, addrs, func(ctx context.Context, round int, addrs []net.IP) (net.Conn, *Egress, error) {
+		if round == 0 {
+			return race(ctx, addrs, port, opts, selected)
+		}
+
+		// The session gets a new address from its pools
+		if opts.Session != "" {
+			sessions.Delete(opts.Session)
+			log.Info().Str("session", opts.Session).Msg("Re-pinning session after connection failure")
+		}
+
+		return race(ctx, addrs, port, opts, nil)
+	})
+}
+
+// getRetryPolicy returns the configured retry policy
+func getRetryPolicy() RetryPolicy {
+	cfg := config.Get().DialRetry
+
+	return RetryPolicy{
+		Attempts:     max(cfg.Attempts, 1),
+		Timeout:      time.Duration(cfg.Timeout) * time.Second,
+		SwitchFamily: cfg.SwitchFamily,
+	}
+}
+
+// dialRetry dials the addresses in rounds until a connection is established, a failure
+// can't be retried, or the policy is exhausted. The errors of every round are returned otherwise.
+func dialRetry(policy RetryPolicy, addrs []net.IP, dial dialFunc) (net.Conn, *Egress, error) {
+	ctx := context.Background()
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+
+	attempts := max(policy.Attempts, 1)
+	var errs []error
+	for round := 0; ; round++ {
+		if round > 0 && policy.SwitchFamily && len(addrs) > 0 {
+			addrs = interleave(addrs, addrs[0].To4() != nil)
+		}
+
+		conn, egress, err := dial(ctx, round, addrs)
+		if err == nil {
+			return conn, egress, nil
+		}
+
+		errs = append(errs, err)
+		if round+1 >= attempts || !isRetryable(err) || ctx.Err() != nil {
+			break
+		}
+
+		log.Warn().Err(err).Int("attempt", round+1).Int("attempts", attempts).Msg("Connection failed, retrying with a new egress")
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// isRetryable returns whether the dial error may not happen with another egress address
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrDestinationDenied) {
+		return false
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
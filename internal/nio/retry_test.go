@@ -0,0 +1,99 @@
+package nio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// closedAddr returns the address of a local listener which was closed, refusing connections
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned error: %v", err)
+	}
+	listener.Close()
+
+	return listener.Addr().String()
+}
+
+func TestDialRetry(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned error: %v", err)
+	}
+	defer listener.Close()
+
+	refused := closedAddr(t)
+	addrs := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::2")}
+
+	var rounds []int
+	var firsts []net.IP
+	dial := func(failures int) dialFunc {
+		rounds, firsts = nil, nil
+		return func(ctx context.Context, round int, addrs []net.IP) (net.Conn, *Egress, error) {
+			rounds = append(rounds, round)
+			firsts = append(firsts, addrs[0])
+
+			addr := listener.Addr().String()
+			if round < failures {
+				addr = refused
+			}
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			return conn, nil, err
+		}
+	}
+
+	conn, _, err := dialRetry(RetryPolicy{Attempts: 3, SwitchFamily: true}, addrs, dial(2))
+	if err != nil {
+		t.Fatalf("dialRetry() returned error: %v", err)
+	}
+	conn.Close()
+
+	if len(rounds) != 3 {
+		t.Errorf("dialRetry() dialed %d rounds, expected 3", len(rounds))
+	}
+	if firsts[0].To4() != nil || firsts[1].To4() == nil || firsts[2].To4() != nil {
+		t.Errorf("dialRetry() started the rounds with %v, expected alternating families", firsts)
+	}
+
+	_, _, err = dialRetry(RetryPolicy{Attempts: 2}, addrs, dial(2))
+	if err == nil {
+		t.Fatalf("dialRetry() returned no error after exhausting its attempts")
+	}
+	if len(rounds) != 2 || !firsts[1].Equal(addrs[0]) {
+		t.Errorf("dialRetry() dialed rounds starting with %v, expected 2 rounds starting with %s", firsts, addrs[0])
+	}
+
+	// Errors other than dialing are not retried
+	rounds = nil
+	_, _, err = dialRetry(RetryPolicy{Attempts: 3}, addrs, func(ctx context.Context, round int, addrs []net.IP) (net.Conn, *Egress, error) {
+		rounds = append(rounds, round)
+		return nil, nil, &net.OpError{Op: "dial", Net: "tcp", Err: ErrDestinationDenied}
+	})
+	if !errors.Is(err, ErrDestinationDenied) || len(rounds) != 1 {
+		t.Errorf("dialRetry() returned %v after %d rounds, expected ErrDestinationDenied after 1", err, len(rounds))
+	}
+}
+
+func TestDialRetryTimeout(t *testing.T) {
+	start := time.Now()
+	rounds := 0
+	_, _, err := dialRetry(RetryPolicy{Attempts: 100, Timeout: 100 * time.Millisecond}, nil, func(ctx context.Context, round int, addrs []net.IP) (net.Conn, *Egress, error) {
+		rounds++
+		<-ctx.Done()
+		return nil, nil, &net.OpError{Op: "dial", Net: "tcp", Err: ctx.Err()}
+	})
+
+	if err == nil || rounds != 1 {
+		t.Errorf("dialRetry() returned %v after %d rounds, expected an error after 1", err, rounds)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dialRetry() returned after %s, expected about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,186 @@
+package nio
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/vlourme/go-proxy/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// kib is the unit of the configured bandwidths.
+const kib = 1024
+
+// userBuckets are the token buckets shared by the connections of a user.
+type userBuckets struct {
+	refs     int
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+var (
+	usersMu sync.Mutex
+	users   = map[string]*userBuckets{}
+)
+
+// Shaper limits the bandwidth of a connection, both on its own and along with
+// the other connections of the user. A nil Shaper doesn't limit anything.
+type Shaper struct {
+	user     string
+	upload   []*rate.Limiter
+	download []*rate.Limiter
+}
+
+// NewShaper returns the shaper of a connection of the user, nil if the limits are unset.
+// It must be released when the connection is closed.
+func NewShaper(user string, limits config.Limits) *Shaper {
+	if limits.Upload == 0 && limits.Download == 0 && limits.ConnectionUpload == 0 && limits.ConnectionDownload == 0 {
+		return nil
+	}
+
+	s := &Shaper{user: user}
+	if bucket := newBucket(limits.ConnectionUpload); bucket != nil {
+		s.upload = append(s.upload, bucket)
+	}
+	if bucket := newBucket(limits.ConnectionDownload); bucket != nil {
+		s.download = append(s.download, bucket)
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	buckets, ok := users[user]
+	if !ok {
+		buckets = &userBuckets{}
+		users[user] = buckets
+	}
+	buckets.refs++
+
+	// The limits may have changed since the buckets were created
+	buckets.upload = updateBucket(buckets.upload, limits.Upload)
+	buckets.download = updateBucket(buckets.download, limits.Download)
+
+	if buckets.upload != nil {
+		s.upload = append(s.upload, buckets.upload)
+	}
+	if buckets.download != nil {
+		s.download = append(s.download, buckets.download)
+	}
+
+	return s
+}
+
+// Release releases the buckets shared with the other connections of the user
+func (s *Shaper) Release() {
+	if s == nil {
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if buckets, ok := users[s.user]; ok {
+		buckets.refs--
+		if buckets.refs == 0 {
+			delete(users, s.user)
+		}
+	}
+}
+
+// Upload waits for the tokens of a chunk sent by the user in the upload buckets
+func (s *Shaper) Upload(n int) {
+	if s != nil {
+		wait(s.upload, n)
+	}
+}
+
+// Download waits for the tokens of a chunk sent to the user in the download buckets
+func (s *Shaper) Download(n int) {
+	if s != nil {
+		wait(s.download, n)
+	}
+}
+
+// Writer returns the writer waiting for the upload buckets before writing to w
+func (s *Shaper) Writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+
+	return &shapedWriter{Writer: w, shaper: s}
+}
+
+// shapedWriter waits for the upload buckets before each write.
+type shapedWriter struct {
+	io.Writer
+	shaper *Shaper
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	w.shaper.Upload(len(p))
+	return w.Writer.Write(p)
+}
+
+// MaxChunk returns the size of the smallest bucket, chunks can't be larger
+func (s *Shaper) MaxChunk() int {
+	chunk := bufferSize
+	if s == nil {
+		return chunk
+	}
+
+	for _, buckets := range [][]*rate.Limiter{s.upload, s.download} {
+		for _, bucket := range buckets {
+			chunk = min(chunk, bucket.Burst())
+		}
+	}
+
+	return chunk
+}
+
+// newBucket returns a token bucket of the bandwidth in KiB/s holding one second of traffic,
+// nil if unlimited
+func newBucket(bandwidth int) *rate.Limiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bandwidth*kib), bandwidth*kib)
+}
+
+// updateBucket returns the bucket set to the bandwidth in KiB/s, created if needed
+func updateBucket(bucket *rate.Limiter, bandwidth int) *rate.Limiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+
+	if bucket == nil {
+		return newBucket(bandwidth)
+	}
+
+	if bucket.Burst() != bandwidth*kib {
+		bucket.SetLimit(rate.Limit(bandwidth * kib))
+		bucket.SetBurst(bandwidth * kib)
+	}
+
+	return bucket
+}
+
+// wait waits for the tokens of the bytes in every bucket, by chunks of at most the burst
+// of the bucket which the limits may lower meanwhile
+func wait(buckets []*rate.Limiter, n int) {
+	for _, bucket := range buckets {
+		for remaining := n; remaining > 0; {
+			chunk := min(remaining, bucket.Burst())
+			if chunk <= 0 {
+				break
+			}
+
+			// The burst was lowered since it was read, wait again for a smaller chunk
+			if err := bucket.WaitN(context.Background(), chunk); err != nil {
+				continue
+			}
+			remaining -= chunk
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package nio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vlourme/go-proxy/internal/config"
+)
+
+func TestShaper(t *testing.T) {
+	if shaper := NewShaper("john", config.Limits{}); shaper != nil {
+		t.Errorf("NewShaper() returned a shaper without limits")
+	}
+
+	limits := config.Limits{Download: 256, ConnectionUpload: 512}
+	first := NewShaper("john", limits)
+	second := NewShaper("john", limits)
+
+	if len(first.download) != 1 || first.download[0] != second.download[0] {
+		t.Errorf("NewShaper() returned download buckets not shared by the connections of the user")
+	}
+	if len(first.upload) != 1 || first.upload[0] == second.upload[0] {
+		t.Errorf("NewShaper() returned upload buckets shared by the connections")
+	}
+
+	if chunk := first.MaxChunk(); chunk != bufferSize {
+		t.Errorf("MaxChunk() = %d, expected the buffer size", chunk)
+	}
+	slow := NewShaper("jane", config.Limits{ConnectionUpload: 16})
+	defer slow.Release()
+	if chunk := slow.MaxChunk(); chunk != 16*kib {
+		t.Errorf("MaxChunk() = %d, expected the smallest bucket", chunk)
+	}
+
+	// The burst of one second passes at once, the remaining half second is throttled
+	start := time.Now()
+	first.Download(256 * kib)
+	second.Download(128 * kib)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Download() took %v, expected about 500ms", elapsed)
+	}
+
+	// Chunks larger than the bucket are throttled too
+	start = time.Now()
+	slow.Upload(24 * kib)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Upload() of a chunk larger than the burst took %v, expected about 500ms", elapsed)
+	}
+
+	first.Release()
+	second.Release()
+	if _, ok := users["john"]; ok {
+		t.Errorf("Release() kept the buckets of the user")
+	}
+}
@@ -0,0 +1,128 @@
+package nio
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// pipe is the kernel buffer data is spliced through.
+type pipe struct {
+	r, w int
+	// data is the number of bytes in the pipe
+	data int
+}
+
+// pipes are the empty pipes, closed by their finalizer when dropped by the pool.
+var pipes = sync.Pool{
+	New: func() any {
+		p, err := newPipe()
+		if err != nil {
+			return nil
+		}
+		return p
+	},
+}
+
+func newPipe() (*pipe, error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+
+	// The pipe must fit a chunk, which is already the default size
+	unix.FcntlInt(uintptr(fds[0]), unix.F_SETPIPE_SZ, bufferSize)
+
+	p := &pipe{r: fds[0], w: fds[1]}
+	runtime.SetFinalizer(p, (*pipe).close)
+
+	return p, nil
+}
+
+func (p *pipe) close() {
+	unix.Close(p.r)
+	unix.Close(p.w)
+}
+
+// release returns the pipe to the pool, or closes it if it holds data
+func (p *pipe) release() {
+	if p.data > 0 {
+		runtime.SetFinalizer(p, nil)
+		p.close()
+		return
+	}
+
+	pipes.Put(p)
+}
+
+// splice moves data from src to dst through a pooled pipe until EOF or an error,
+// without copying it to user space. The deadlines of the connections apply.
+func splice(dst, src *net.TCPConn, chunk int, observe func(int)) (int64, error) {
+	p, _ := pipes.Get().(*pipe)
+	if p == nil {
+		return 0, errors.ErrUnsupported
+	}
+	defer p.release()
+
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for {
+		n, err := spliceOnce(srcConn.Read, p.w, chunk, true)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+
+		p.data += n
+		observe(n)
+
+		for p.data > 0 {
+			n, err := spliceOnce(dstConn.Write, p.r, p.data, false)
+			if err != nil {
+				return written, err
+			}
+
+			p.data -= n
+			written += int64(n)
+		}
+	}
+}
+
+// spliceOnce splices up to size bytes between the socket and the pipe, waiting for the
+// socket to be ready through the poller. Zero bytes read from the socket is EOF.
+func spliceOnce(wait func(func(uintptr) bool) error, pipeFd int, size int, fromSocket bool) (int, error) {
+	var n int64
+	var serr error
+
+	err := wait(func(fd uintptr) bool {
+		for {
+			if fromSocket {
+				n, serr = unix.Splice(int(fd), nil, pipeFd, nil, size, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			} else {
+				n, serr = unix.Splice(pipeFd, nil, int(fd), nil, size, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			}
+
+			if serr != unix.EINTR {
+				return serr != unix.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), serr
+}
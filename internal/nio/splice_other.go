@@ -0,0 +1,13 @@
+//go:build !linux
+
+package nio
+
+import (
+	"errors"
+	"net"
+)
+
+// splice is only supported on Linux, data is copied instead.
+func splice(dst, src *net.TCPConn, chunk int, observe func(int)) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,84 @@
+package nio
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts are the timeouts of a relayed connection, zero is unlimited.
+type Timeouts struct {
+	// Idle is the time without traffic in either direction after which the connection is closed.
+	Idle time.Duration
+	// Lifetime is the maximum duration of the connection, whatever the traffic.
+	Lifetime time.Duration
+}
+
+// Lower returns the timeouts lowered to the ones set in other
+func (t Timeouts) Lower(other Timeouts) Timeouts {
+	lower := func(value, with time.Duration) time.Duration {
+		if with > 0 && (value == 0 || with < value) {
+			return with
+		}
+		return value
+	}
+
+	return Timeouts{
+		Idle:     lower(t.Idle, other.Idle),
+		Lifetime: lower(t.Lifetime, other.Lifetime),
+	}
+}
+
+// watchdog expires the deadline of the connections once no data was relayed for the idle timeout.
+type watchdog struct {
+	idle    time.Duration
+	conns   []net.Conn
+	last    atomic.Int64
+	stopped atomic.Bool
+	timer   *time.Timer
+}
+
+// newWatchdog starts watching the activity of the connections
+func newWatchdog(idle time.Duration, conns ...net.Conn) *watchdog {
+	w := &watchdog{idle: idle, conns: conns}
+	w.touch()
+	w.timer = time.AfterFunc(idle, w.check)
+
+	return w
+}
+
+// touch records activity
+func (w *watchdog) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// check expires the connections if idle, or checks again when they would be
+func (w *watchdog) check() {
+	if w.stopped.Load() {
+		return
+	}
+
+	idle := time.Since(time.Unix(0, w.last.Load()))
+	if idle < w.idle {
+		w.timer.Reset(w.idle - idle)
+		return
+	}
+
+	for _, conn := range w.conns {
+		conn.SetDeadline(time.Now())
+	}
+}
+
+// stop stops watching the connections
+func (w *watchdog) stop() {
+	w.stopped.Store(true)
+	w.timer.Stop()
+}
+
+func (w *watchdog) Upload(n int) {
+	w.touch()
+}
+
+func (w *watchdog) Download(n int) {
+	w.touch()
+}
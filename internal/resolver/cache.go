@@ -0,0 +1,180 @@
+package resolver
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/lru"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultCacheSize is the number of entries of the cache.
+	DefaultCacheSize = 4096
+	// DefaultMaxTTL is the longest period an answer is cached.
+	DefaultMaxTTL = time.Hour
+	// DefaultNegativeTTL is the longest period a negative answer is cached.
+	DefaultNegativeTTL = 30 * time.Second
+	// prefetchHits is the number of hits after which an entry is prefetched.
+	prefetchHits = 2
+)
+
+// CacheConfig is the configuration of the cache of a resolver.
+type CacheConfig struct {
+	// Size is the number of entries, defaults to 4096.
+	Size int `yaml:"size"`
+	// MinTTL is the shortest period in seconds an answer is cached, whatever the record TTL.
+	MinTTL int `yaml:"min_ttl"`
+	// MaxTTL is the longest period in seconds an answer is cached, defaults to 3600.
+	MaxTTL int `yaml:"max_ttl"`
+	// NegativeTTL is the longest period in seconds a missing host is cached, defaults to 30.
+	NegativeTTL int `yaml:"negative_ttl"`
+	// Prefetch is the percentage of the TTL left under which entries hit again are
+	// refreshed in the background, zero disables prefetching.
+	Prefetch int `yaml:"prefetch"`
+}
+
+// CacheStats are the counters of a cache.
+type CacheStats struct {
+	Entries    int    `json:"entries"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Prefetches uint64 `json:"prefetches"`
+}
+
+type cacheEntry struct {
+	answer      Answer
+	err         error
+	ttl         time.Duration
+	expires     time.Time
+	hits        atomic.Uint32
+	prefetching atomic.Bool
+}
+
+// Cache caches answers for the TTL of their records, including missing hosts.
+// Concurrent misses of the same key are coalesced into one lookup.
+type Cache struct {
+	entries     *lru.TTLCache[string, *cacheEntry]
+	group       singleflight.Group
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	prefetch    int
+
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	prefetches atomic.Uint64
+}
+
+// NewCache returns a cache for the configuration
+func NewCache(cfg CacheConfig) *Cache {
+	c := &Cache{
+		minTTL:      time.Duration(cfg.MinTTL) * time.Second,
+		maxTTL:      time.Duration(cfg.MaxTTL) * time.Second,
+		negativeTTL: time.Duration(cfg.NegativeTTL) * time.Second,
+		prefetch:    cfg.Prefetch,
+	}
+	if c.maxTTL <= 0 {
+		c.maxTTL = DefaultMaxTTL
+	}
+	if c.negativeTTL <= 0 {
+		c.negativeTTL = DefaultNegativeTTL
+	}
+
+	size := cfg.Size
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	c.entries = lru.NewTTLCache[string, *cacheEntry](size)
+
+	return c
+}
+
+// Get returns the cached answer of the key, calling lookup on a miss.
+// Failed lookups are not cached, but missing hosts are.
+func (c *Cache) Get(key string, lookup func() (Answer, error)) (Answer, error) {
+	if entry, ok := c.entries.Get(key); ok && time.Now().Before(entry.expires) {
+		c.hits.Add(1)
+		if c.shouldPrefetch(entry) {
+			go c.refresh(key, entry, lookup)
+		}
+		return entry.answer, entry.err
+	}
+
+	c.misses.Add(1)
+	return c.fetch(key, lookup)
+}
+
+// Stats returns the counters of the cache
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Entries:    c.entries.Len(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Prefetches: c.prefetches.Load(),
+	}
+}
+
+// fetch looks up the key once for every concurrent caller and stores the answer
+func (c *Cache) fetch(key string, lookup func() (Answer, error)) (Answer, error) {
+	value, err, _ := c.group.Do(key, func() (any, error) {
+		answer, err := lookup()
+		c.store(key, answer, err)
+		return answer, err
+	})
+
+	answer, _ := value.(Answer)
+	return answer, err
+}
+
+// store caches the answer for its TTL within the clamps
+func (c *Cache) store(key string, answer Answer, err error) {
+	negative := errors.Is(err, ErrNotFound) || (err == nil && len(answer.IPs) == 0)
+	if err != nil && !negative {
+		return
+	}
+
+	ttl := answer.TTL
+	if negative {
+		if ttl <= 0 || ttl > c.negativeTTL {
+			ttl = c.negativeTTL
+		}
+	} else {
+		ttl = min(max(ttl, c.minTTL), c.maxTTL)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	// The expiry of the LRU has a resolution of a second, the entry expiry is checked on get
+	c.entries.Set(key, &cacheEntry{
+		answer:  answer,
+		err:     err,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+	}, ttl+time.Second)
+}
+
+// shouldPrefetch returns whether the entry is hit often and expires soon,
+// only one prefetch is started per entry
+func (c *Cache) shouldPrefetch(entry *cacheEntry) bool {
+	if c.prefetch <= 0 || entry.hits.Add(1) < prefetchHits {
+		return false
+	}
+
+	if time.Until(entry.expires) > entry.ttl*time.Duration(c.prefetch)/100 {
+		return false
+	}
+
+	return entry.prefetching.CompareAndSwap(false, true)
+}
+
+// refresh looks up the key again before the entry expires
+func (c *Cache) refresh(key string, entry *cacheEntry, lookup func() (Answer, error)) {
+	c.prefetches.Add(1)
+	if _, err := c.fetch(key, lookup); err != nil && !errors.Is(err, ErrNotFound) {
+		// The entry is served until it expires, another prefetch may be tried
+		entry.prefetching.Store(false)
+	}
+}
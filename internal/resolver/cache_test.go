@@ -0,0 +1,136 @@
+package resolver
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      CacheConfig
+		ttl      time.Duration
+		err      error
+		ips      []net.IP
+		expected time.Duration
+	}{
+		{"record TTL", CacheConfig{}, 2 * time.Minute, nil, []net.IP{net.ParseIP("192.0.2.1")}, 2 * time.Minute},
+		{"min clamp", CacheConfig{MinTTL: 60}, 5 * time.Second, nil, []net.IP{net.ParseIP("192.0.2.1")}, time.Minute},
+		{"max clamp", CacheConfig{MaxTTL: 60}, time.Hour, nil, []net.IP{net.ParseIP("192.0.2.1")}, time.Minute},
+		{"negative", CacheConfig{NegativeTTL: 10}, time.Hour, ErrNotFound, nil, 10 * time.Second},
+		{"negative without SOA", CacheConfig{}, 0, ErrNotFound, nil, DefaultNegativeTTL},
+		{"no data", CacheConfig{}, 5 * time.Second, nil, nil, 5 * time.Second},
+		{"failure", CacheConfig{}, time.Minute, errors.New("timeout"), nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(tt.cfg)
+			c.store("example.com", Answer{IPs: tt.ips, TTL: tt.ttl}, tt.err)
+
+			entry, ok := c.entries.Get("example.com")
+			if tt.expected == 0 {
+				if ok {
+					t.Errorf("store() cached the answer, expected nothing")
+				}
+				return
+			}
+
+			if !ok {
+				t.Fatalf("store() did not cache the answer")
+			}
+			if entry.ttl != tt.expected {
+				t.Errorf("store() cached for %v, expected %v", entry.ttl, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	c := NewCache(CacheConfig{})
+
+	var lookups atomic.Int32
+	lookup := func() (Answer, error) {
+		lookups.Add(1)
+		return Answer{TTL: time.Minute}, ErrNotFound
+	}
+
+	for range 3 {
+		if _, err := c.Get("missing.example.com", lookup); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() returned %v, expected ErrNotFound", err)
+		}
+	}
+
+	if lookups.Load() != 1 {
+		t.Errorf("Get() looked up %d times, expected 1", lookups.Load())
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Stats() returned %+v, expected 2 hits, 1 miss and 1 entry", stats)
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	c := NewCache(CacheConfig{})
+
+	var lookups atomic.Int32
+	release := make(chan struct{})
+	lookup := func() (Answer, error) {
+		lookups.Add(1)
+		<-release
+		return Answer{IPs: []net.IP{net.ParseIP("192.0.2.1")}, TTL: time.Minute}, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer, err := c.Get("example.com", lookup)
+			if err != nil || len(answer.IPs) != 1 {
+				t.Errorf("Get() returned %v, %v", answer.IPs, err)
+			}
+		}()
+	}
+
+	// Let the callers pile up on the pending lookup
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if lookups.Load() != 1 {
+		t.Errorf("Get() looked up %d times, expected 1", lookups.Load())
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := NewCache(CacheConfig{Prefetch: 100})
+
+	refreshed := make(chan struct{}, 1)
+	var lookups atomic.Int32
+	lookup := func() (Answer, error) {
+		if lookups.Add(1) > 1 {
+			refreshed <- struct{}{}
+		}
+		return Answer{IPs: []net.IP{net.ParseIP("192.0.2.1")}, TTL: time.Minute}, nil
+	}
+
+	for range prefetchHits + 1 {
+		c.Get("example.com", lookup)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("Get() did not prefetch a hot entry")
+	}
+
+	if c.Stats().Prefetches != 1 {
+		t.Errorf("Stats() returned %d prefetches, expected 1", c.Stats().Prefetches)
+	}
+}
@@ -0,0 +1,364 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrNotFound         = errors.New("no such host")
+	ErrNoUpstream       = errors.New("no DNS upstream configured")
+	ErrNoUpstreamFamily = errors.New("no DNS upstream of the egress address family")
+	ErrUpstreamFailure  = errors.New("DNS upstreams failed")
+)
+
+// DefaultUpstream is the upstream used when none is configured.
+var DefaultUpstream = UpstreamConfig{Address: "1.1.1.1:53", Transport: TransportUDP}
+
+// DefaultTimeout is the timeout of a query to an upstream.
+const DefaultTimeout = 2 * time.Second
+
+// Config is the configuration of a resolver.
+type Config struct {
+	// Upstreams is the list of upstream servers, by order of preference.
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	// Timeout is the timeout of a query to an upstream in milliseconds, defaults to 2000.
+	Timeout int `yaml:"timeout"`
+	// Parallel is the number of upstreams queried at once, defaults to 1.
+	Parallel int `yaml:"parallel"`
+	// Cache is the configuration of the cache of answers.
+	Cache CacheConfig `yaml:"cache"`
+	// ClientSubnet is the configuration of the EDNS Client Subnet sent to the upstreams.
+	ClientSubnet ClientSubnetConfig `yaml:"client_subnet"`
+	// Egress is the configuration of the queries sent from the egress address.
+	Egress EgressConfig `yaml:"egress"`
+}
+
+// EgressConfig is the configuration of the queries sent from the egress address.
+type EgressConfig struct {
+	// Bind is whether queries are sent from the egress address of the connection,
+	// only to the upstreams of its family.
+	Bind bool `yaml:"bind"`
+	// BypassCache is whether such queries skip the shared cache.
+	BypassCache bool `yaml:"bypass_cache"`
+}
+
+// ClientSubnetConfig is the configuration of the EDNS Client Subnet (RFC 7871).
+type ClientSubnetConfig struct {
+	// Enabled is whether the subnet of the egress address is sent to the upstreams.
+	Enabled bool `yaml:"enabled"`
+	// IPv4 is the length of the IPv4 subnet sent, defaults to 24.
+	IPv4 int `yaml:"ipv4"`
+	// IPv6 is the length of the IPv6 subnet sent, defaults to 56.
+	IPv6 int `yaml:"ipv6"`
+}
+
+// Query are the options of a lookup.
+type Query struct {
+	// Subnet is the EDNS Client Subnet sent to the upstreams, nil for none.
+	Subnet *net.IPNet
+	// LocalAddr is the address the queries are sent from, nil for any.
+	LocalAddr net.IP
+}
+
+// key returns the cache key of the host for the query
+func (q Query) key(host string) string {
+	if q.Subnet == nil {
+		return host
+	}
+
+	return host + "/" + q.Subnet.String()
+}
+
+// Resolver sends queries to a list of upstreams, with health tracking and failover.
+type Resolver struct {
+	upstreams []*Upstream
+	timeout   time.Duration
+	parallel  int
+	cache     *Cache
+	subnet    ClientSubnetConfig
+	egress    EgressConfig
+}
+
+// Answer is the result of a lookup.
+type Answer struct {
+	// IPs are the addresses, IPv6 first.
+	IPs []net.IP
+	// TTL is the lowest TTL of the records.
+	TTL time.Duration
+}
+
+// New returns a resolver for the configuration
+func New(cfg Config) (*Resolver, error) {
+	r := &Resolver{
+		timeout:  time.Duration(cfg.Timeout) * time.Millisecond,
+		parallel: max(cfg.Parallel, 1),
+		cache:    NewCache(cfg.Cache),
+		subnet:   cfg.ClientSubnet,
+		egress:   cfg.Egress,
+	}
+	if r.subnet.IPv4 <= 0 || r.subnet.IPv4 > 32 {
+		r.subnet.IPv4 = 24
+	}
+	if r.subnet.IPv6 <= 0 || r.subnet.IPv6 > 128 {
+		r.subnet.IPv6 = 56
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultTimeout
+	}
+
+	upstreams := cfg.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = []UpstreamConfig{DefaultUpstream}
+	}
+
+	for _, upstreamCfg := range upstreams {
+		upstream, err := NewUpstream(upstreamCfg)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+
+	return r, nil
+}
+
+// Upstreams returns the upstreams of the resolver
+func (r *Resolver) Upstreams() []*Upstream {
+	return r.upstreams
+}
+
+// Resolve returns the addresses of the host from the cache, looking them up on a miss.
+// Answers are cached per client subnet, queries sent from a local address skip the
+// cache if configured.
+func (r *Resolver) Resolve(host string, query Query) (Answer, error) {
+	if query.LocalAddr != nil && r.egress.BypassCache {
+		return r.LookupIP(context.Background(), host, query)
+	}
+
+	return r.cache.Get(query.key(host), func() (Answer, error) {
+		return r.LookupIP(context.Background(), host, query)
+	})
+}
+
+// UsesEgress returns whether lookups depend on the egress address
+func (r *Resolver) UsesEgress() bool {
+	return r.subnet.Enabled || r.egress.Bind
+}
+
+// Query returns the query options for the egress address
+func (r *Resolver) Query(egress net.IP) Query {
+	query := Query{Subnet: r.ClientSubnet(egress)}
+	if r.egress.Bind {
+		query.LocalAddr = egress
+	}
+
+	return query
+}
+
+// ClientSubnet returns the client subnet of the egress address, nil if disabled
+func (r *Resolver) ClientSubnet(ip net.IP) *net.IPNet {
+	if !r.subnet.Enabled || ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(r.subnet.IPv4, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+
+	mask := net.CIDRMask(r.subnet.IPv6, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Stats returns the counters of the cache
+func (r *Resolver) Stats() CacheStats {
+	return r.cache.Stats()
+}
+
+// Exchange sends the query to the upstreams from the local address, if not nil,
+// and returns the first valid response.
+//
+//   - Healthy upstreams are queried first by order of preference, unhealthy ones are a last resort.
+//   - Upstreams are queried by batches of the parallel setting, the next batch is
+//     queried if every upstream of the batch failed.
+//   - Responses other than NOERROR and NXDOMAIN are failures.
+//   - Only the upstreams of the family of the local address are queried.
+//   - If every upstream failed, the error wraps ErrUpstreamFailure and the error of each upstream.
+func (r *Resolver) Exchange(ctx context.Context, msg *dns.Msg, local net.IP) (*dns.Msg, error) {
+	if len(r.upstreams) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	ordered := make([]*Upstream, 0, len(r.upstreams))
+	var unhealthy []*Upstream
+	for _, upstream := range r.upstreams {
+		if local != nil && !upstream.Reaches(local) {
+			continue
+		}
+
+		if upstream.Healthy() {
+			ordered = append(ordered, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+	ordered = append(ordered, unhealthy...)
+	if len(ordered) == 0 {
+		return nil, ErrNoUpstreamFamily
+	}
+
+	var errs []error
+	for i := 0; i < len(ordered); i += r.parallel {
+		batch := ordered[i:min(i+r.parallel, len(ordered))]
+		resp, err := r.exchangeBatch(ctx, batch, msg, local)
+		if err == nil {
+			return resp, nil
+		}
+
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrUpstreamFailure, errors.Join(errs...))
+}
+
+type exchangeResult struct {
+	resp *dns.Msg
+	err  error
+}
+
+// exchangeBatch queries the upstreams at once and returns the first valid response
+func (r *Resolver) exchangeBatch(ctx context.Context, batch []*Upstream, msg *dns.Msg, local net.IP) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	results := make(chan exchangeResult, len(batch))
+	for _, upstream := range batch {
+		go func() {
+			resp, err := upstream.Exchange(ctx, msg.Copy(), local)
+			if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+				err = fmt.Errorf("%s: %s", upstream, dns.RcodeToString[resp.Rcode])
+			} else if err != nil {
+				err = fmt.Errorf("%s: %w", upstream, err)
+			}
+
+			// Losers of a parallel query are not failures
+			if !errors.Is(err, context.Canceled) {
+				upstream.report(err)
+			}
+			results <- exchangeResult{resp: resp, err: err}
+		}()
+	}
+
+	var errs []error
+	for range batch {
+		result := <-results
+		if result.err == nil {
+			return result.resp, nil
+		}
+		errs = append(errs, result.err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// Lookup queries the records of the given type, A or AAAA
+func (r *Resolver) Lookup(ctx context.Context, host string, qtype uint16, query Query) (Answer, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	msg.SetEdns0(1232, false)
+
+	if query.Subnet != nil {
+		ones, bits := query.Subnet.Mask.Size()
+		ecs := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			Address:       query.Subnet.IP,
+		}
+		if bits == 128 {
+			ecs.Family = 2
+		}
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+
+	resp, err := r.Exchange(ctx, msg, query.LocalAddr)
+	if err != nil {
+		return Answer{}, err
+	}
+
+	if resp.Rcode == dns.RcodeNameError {
+		return Answer{TTL: negativeTTL(resp)}, ErrNotFound
+	}
+
+	answer := Answer{TTL: negativeTTL(resp)}
+	for i, rr := range resp.Answer {
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if i == 0 || ttl < answer.TTL {
+			answer.TTL = ttl
+		}
+
+		switch record := rr.(type) {
+		case *dns.A:
+			answer.IPs = append(answer.IPs, record.A)
+		case *dns.AAAA:
+			answer.IPs = append(answer.IPs, record.AAAA)
+		}
+	}
+
+	return answer, nil
+}
+
+// LookupIP queries the A and AAAA records of the host at once.
+// ErrNotFound is returned if the host does not exist.
+func (r *Resolver) LookupIP(ctx context.Context, host string, query Query) (Answer, error) {
+	var v6, v4 Answer
+	var err6, err4 error
+
+	done := make(chan struct{})
+	go func() {
+		v6, err6 = r.Lookup(ctx, host, dns.TypeAAAA, query)
+		close(done)
+	}()
+	v4, err4 = r.Lookup(ctx, host, dns.TypeA, query)
+	<-done
+
+	if err6 != nil && err4 != nil {
+		if errors.Is(err6, ErrNotFound) && errors.Is(err4, ErrNotFound) {
+			return Answer{TTL: min(v6.TTL, v4.TTL)}, ErrNotFound
+		}
+		return Answer{}, errors.Join(err6, err4)
+	}
+
+	answer := Answer{IPs: append(v6.IPs, v4.IPs...)}
+	switch {
+	case err6 != nil || len(v6.IPs) == 0:
+		answer.TTL = v4.TTL
+	case err4 != nil || len(v4.IPs) == 0:
+		answer.TTL = v6.TTL
+	default:
+		answer.TTL = min(v6.TTL, v4.TTL)
+	}
+
+	return answer, nil
+}
+
+// negativeTTL returns the TTL of negative answers from the SOA record (RFC 2308)
+func negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
+	}
+
+	return 0
+}
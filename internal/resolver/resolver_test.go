@@ -0,0 +1,303 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// stub answers example.com with fixed records and NXDOMAIN for any other name
+func stub(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	question := req.Question[0]
+	if question.Name != "example.com." {
+		resp.Rcode = dns.RcodeNameError
+		soa, _ := dns.NewRR(". 3600 IN SOA ns. admin. 1 3600 600 86400 30")
+		resp.Ns = append(resp.Ns, soa)
+		w.WriteMsg(resp)
+		return
+	}
+
+	switch question.Qtype {
+	case dns.TypeA:
+		rr, _ := dns.NewRR("example.com. 120 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+	case dns.TypeAAAA:
+		rr, _ := dns.NewRR("example.com. 60 IN AAAA 2001:db8::1")
+		resp.Answer = append(resp.Answer, rr)
+	}
+	w.WriteMsg(resp)
+}
+
+// startStub starts a stub server and returns its address
+func startStub(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() returned an error: %v", err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+// deadAddress returns the address of a closed UDP port
+func deadAddress(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() returned an error: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	return addr
+}
+
+func TestLookupIP(t *testing.T) {
+	r, err := New(Config{Upstreams: []UpstreamConfig{{Address: startStub(t, stub)}}})
+	if err != nil {
+		t.Fatalf("New() returned an error: %v", err)
+	}
+
+	answer, err := r.LookupIP(context.Background(), "example.com", Query{})
+	if err != nil {
+		t.Fatalf("LookupIP() returned an error: %v", err)
+	}
+
+	if len(answer.IPs) != 2 || !answer.IPs[0].Equal(net.ParseIP("2001:db8::1")) || !answer.IPs[1].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("LookupIP() returned %v, expected [2001:db8::1 192.0.2.1]", answer.IPs)
+	}
+	if answer.TTL.Seconds() != 60 {
+		t.Errorf("LookupIP() returned a TTL of %v, expected 1m0s", answer.TTL)
+	}
+
+	answer, err = r.LookupIP(context.Background(), "missing.example.com", Query{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupIP() returned %v, expected ErrNotFound", err)
+	}
+	if answer.TTL.Seconds() != 30 {
+		t.Errorf("LookupIP() returned a negative TTL of %v, expected 30s", answer.TTL)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	servfail := func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+	}
+
+	r, err := New(Config{
+		Upstreams: []UpstreamConfig{
+			{Address: deadAddress(t)},
+			{Address: startStub(t, servfail)},
+			{Address: startStub(t, stub)},
+		},
+		Timeout: 200,
+	})
+	if err != nil {
+		t.Fatalf("New() returned an error: %v", err)
+	}
+
+	for range failureThreshold {
+		answer, err := r.LookupIP(context.Background(), "example.com", Query{})
+		if err != nil {
+			t.Fatalf("LookupIP() returned an error: %v", err)
+		}
+		if len(answer.IPs) != 2 {
+			t.Errorf("LookupIP() returned %v, expected 2 addresses", answer.IPs)
+		}
+	}
+
+	upstreams := r.Upstreams()
+	if upstreams[0].Healthy() || upstreams[1].Healthy() {
+		t.Errorf("Healthy() returned true for failing upstreams")
+	}
+	if !upstreams[2].Healthy() {
+		t.Errorf("Healthy() returned false for the working upstream")
+	}
+}
+
+func TestParallel(t *testing.T) {
+	r, err := New(Config{
+		Upstreams: []UpstreamConfig{{Address: deadAddress(t)}, {Address: startStub(t, stub)}},
+		Timeout:   5000,
+		Parallel:  2,
+	})
+	if err != nil {
+		t.Fatalf("New() returned an error: %v", err)
+	}
+
+	if _, err := r.LookupIP(context.Background(), "example.com", Query{}); err != nil {
+		t.Errorf("LookupIP() returned an error: %v", err)
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		recorder := &messageWriter{}
+		stub(recorder, req)
+		packed, _ := recorder.msg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	r, err := New(Config{Upstreams: []UpstreamConfig{{Address: server.URL, Transport: TransportHTTPS}}})
+	if err != nil {
+		t.Fatalf("New() returned an error: %v", err)
+	}
+
+	answer, err := r.LookupIP(context.Background(), "example.com", Query{})
+	if err != nil {
+		t.Fatalf("LookupIP() returned an error: %v", err)
+	}
+	if len(answer.IPs) != 2 {
+		t.Errorf("LookupIP() returned %v, expected 2 addresses", answer.IPs)
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	if _, err := NewUpstream(UpstreamConfig{Address: "1.1.1.1:53", Transport: "quic"}); err == nil {
+		t.Errorf("NewUpstream() returned no error for an unknown transport")
+	}
+	if _, err := NewUpstream(UpstreamConfig{Address: "1.1.1.1", Transport: TransportTLS}); err == nil {
+		t.Errorf("NewUpstream() returned no error for an address without port")
+	}
+}
+
+// messageWriter records the message written by a handler
+type messageWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *messageWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func TestClientSubnet(t *testing.T) {
+	// Answers with an address depending on the client subnet
+	ecsStub := func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		address := "192.0.2.1"
+		if opt := req.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if ecs, ok := option.(*dns.EDNS0_SUBNET); ok && ecs.Address.Equal(net.ParseIP("2001:db8:ab00::")) {
+					address = "192.0.2.2"
+				}
+			}
+		}
+
+		if req.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR("example.com. 60 IN A " + address)
+			resp.Answer = append(resp.Answer, rr)
+		}
+		w.WriteMsg(resp)
+	}
+
+	r, err := New(Config{
+		Upstreams:    []UpstreamConfig{{Address: startStub(t, ecsStub)}},
+		ClientSubnet: ClientSubnetConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatalf("New() returned an error: %v", err)
+	}
+
+	subnet := r.ClientSubnet(net.ParseIP("2001:db8:ab00:12::1"))
+	if subnet.String() != "2001:db8:ab00::/56" {
+		t.Fatalf("ClientSubnet() returned %v, expected 2001:db8:ab00::/56", subnet)
+	}
+	if subnet := r.ClientSubnet(net.ParseIP("198.51.100.7")); subnet.String() != "198.51.100.0/24" {
+		t.Errorf("ClientSubnet() returned %v, expected 198.51.100.0/24", subnet)
+	}
+
+	// Answers are cached per subnet
+	for range 2 {
+		answer, err := r.Resolve("example.com", Query{Subnet: subnet})
+		if err != nil || !answer.IPs[0].Equal(net.ParseIP("192.0.2.2")) {
+			t.Errorf("Resolve() returned %v, %v, expected 192.0.2.2", answer.IPs, err)
+		}
+
+		answer, err = r.Resolve("example.com", Query{})
+		if err != nil || !answer.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("Resolve() returned %v, %v, expected 192.0.2.1", answer.IPs, err)
+		}
+	}
+
+	if stats := r.Stats(); stats.Entries != 2 || stats.Hits != 2 {
+		t.Errorf("Stats() returned %+v, expected 2 entries and 2 hits", stats)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	// Answers with the source address of the query
+	sourceStub := func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		if req.Question[0].Qtype == dns.TypeA {
+			source := w.RemoteAddr().(*net.UDPAddr).IP
+			rr, _ := dns.NewRR("example.com. 60 IN A " + source.String())
+			resp.Answer = append(resp.Answer, rr)
+		}
+		w.WriteMsg(resp)
+	}
+
+	r, err := New(Config{
+		Upstreams: []UpstreamConfig{{Address: startStub(t, sourceStub)}},
+		Egress:    EgressConfig{Bind: true, BypassCache: true},
+	})
+	if err != nil {
+		t.Fatalf("New() returned an error: %v", err)
+	}
+
+	for _, source := range []string{"127.0.0.2", "127.0.0.3"} {
+		answer, err := r.Resolve("example.com", r.Query(net.ParseIP(source)))
+		if err != nil {
+			t.Fatalf("Resolve() returned an error: %v", err)
+		}
+		if !answer.IPs[0].Equal(net.ParseIP(source)) {
+			t.Errorf("Resolve() was sent from %v, expected %s", answer.IPs[0], source)
+		}
+	}
+
+	if stats := r.Stats(); stats.Entries != 0 {
+		t.Errorf("Stats() returned %d entries, expected the cache to be bypassed", stats.Entries)
+	}
+
+	if _, err := r.Resolve("example.com", r.Query(net.ParseIP("::1"))); !errors.Is(err, ErrNoUpstreamFamily) {
+		t.Errorf("Resolve() returned %v, expected ErrNoUpstreamFamily", err)
+	}
+}
@@ -0,0 +1,223 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	TransportUDP   string = "udp"
+	TransportTCP   string = "tcp"
+	TransportTLS   string = "tls"
+	TransportHTTPS string = "https"
+)
+
+const (
+	// failureThreshold is the number of consecutive failures before an upstream is unhealthy.
+	failureThreshold = 3
+	// minBackoff is the first period during which an unhealthy upstream is avoided.
+	minBackoff = 10 * time.Second
+	// maxBackoff is the longest period during which an unhealthy upstream is avoided.
+	maxBackoff = 5 * time.Minute
+)
+
+// UpstreamConfig is the configuration of an upstream server.
+type UpstreamConfig struct {
+	// Address is host:port for udp, tcp and tls, or the URL for https.
+	Address string `yaml:"address"`
+	// Transport is udp (default), tcp, tls (DNS over TLS) or https (DNS over HTTPS).
+	Transport string `yaml:"transport"`
+	// ServerName is the TLS server name for tls, defaults to the host of the address.
+	ServerName string `yaml:"server_name"`
+}
+
+// Upstream is an upstream server along with its health.
+type Upstream struct {
+	address   string
+	transport string
+	client    *dns.Client
+	http      *http.Client
+
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+// NewUpstream returns an upstream for the configuration
+func NewUpstream(cfg UpstreamConfig) (*Upstream, error) {
+	u := &Upstream{address: cfg.Address, transport: cfg.Transport}
+
+	switch cfg.Transport {
+	case "", TransportUDP:
+		u.transport = TransportUDP
+		u.client = &dns.Client{Net: "udp"}
+	case TransportTCP:
+		u.client = &dns.Client{Net: "tcp"}
+	case TransportTLS:
+		serverName := cfg.ServerName
+		if serverName == "" {
+			host, _, err := net.SplitHostPort(cfg.Address)
+			if err != nil {
+				return nil, err
+			}
+			serverName = host
+		}
+		u.client = &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: serverName}}
+	case TransportHTTPS:
+		u.http = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unknown DNS transport: %s", cfg.Transport)
+	}
+
+	return u, nil
+}
+
+// String returns the transport and address of the upstream
+func (u *Upstream) String() string {
+	return u.transport + "://" + u.address
+}
+
+// Exchange sends the query to the upstream from the local address, if not nil.
+// UDP responses which are truncated are retried over TCP.
+func (u *Upstream) Exchange(ctx context.Context, msg *dns.Msg, local net.IP) (*dns.Msg, error) {
+	if u.transport == TransportHTTPS {
+		return u.exchangeHTTPS(ctx, msg, local)
+	}
+
+	client := u.client
+	if local != nil {
+		bound := *u.client
+		bound.Dialer = &net.Dialer{LocalAddr: localAddr(bound.Net, local)}
+		client = &bound
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, u.address)
+	if err == nil && resp.Truncated && u.transport == TransportUDP {
+		tcp := *client
+		tcp.Net = "tcp"
+		if local != nil {
+			tcp.Dialer = &net.Dialer{LocalAddr: localAddr(tcp.Net, local)}
+		}
+		resp, _, err = tcp.ExchangeContext(ctx, msg, u.address)
+	}
+
+	return resp, err
+}
+
+// Reaches returns whether the upstream can be queried from the local address,
+// which must be of the same family as the upstream address. Upstreams with a
+// hostname are assumed to have addresses of both families.
+func (u *Upstream) Reaches(local net.IP) bool {
+	host := u.address
+	if u.transport == TransportHTTPS {
+		parsed, err := url.Parse(u.address)
+		if err != nil {
+			return false
+		}
+		host = parsed.Hostname()
+	} else if h, _, err := net.SplitHostPort(u.address); err == nil {
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	return ip == nil || (ip.To4() == nil) == (local.To4() == nil)
+}
+
+// exchangeHTTPS sends the query with DNS over HTTPS (RFC 8484)
+func (u *Upstream) exchangeHTTPS(ctx context.Context, msg *dns.Msg, local net.IP) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.address, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := u.http
+	if local != nil {
+		// Connections are not shared across local addresses
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		dialer := &net.Dialer{LocalAddr: localAddr("tcp", local)}
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if local.To4() == nil {
+				return dialer.DialContext(ctx, "tcp6", address)
+			}
+			return dialer.DialContext(ctx, "tcp4", address)
+		}
+		defer transport.CloseIdleConnections()
+		client = &http.Client{Transport: transport}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(dns.Msg)
+	if err := result.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// localAddr returns the local address of the network
+func localAddr(network string, ip net.IP) net.Addr {
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip}
+	}
+
+	return &net.TCPAddr{IP: ip}
+}
+
+// Healthy returns whether the upstream is not avoided after consecutive failures
+func (u *Upstream) Healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return time.Now().After(u.downUntil)
+}
+
+// report records the result of an exchange. After failureThreshold consecutive
+// failures, the upstream is avoided for a period doubling on every failure.
+func (u *Upstream) report(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err == nil {
+		u.failures = 0
+		u.downUntil = time.Time{}
+		return
+	}
+
+	u.failures++
+	if u.failures >= failureThreshold {
+		backoff := min(minBackoff<<min(u.failures-failureThreshold, 16), maxBackoff)
+		u.downUntil = time.Now().Add(backoff)
+	}
+}
@@ -1,62 +1,269 @@
 package utils
 
 import (
+	"errors"
 	"net"
 )
 
+var (
+	ErrInvalidPrefix = errors.New("invalid prefix")
+	ErrNoAddress     = errors.New("no usable address in prefix")
+)
+
+// maxAttempts is the number of draws before giving up on finding
+// a non-reserved address, only reachable with tiny prefixes.
+const maxAttempts = 64
+
 // GenerateIP generates a random IP address based on the given CIDR
 func GenerateIP(cidr net.IPNet) (net.IP, error) {
-	if cidr.IP.To4() != nil {
-		return generateIPv4(cidr.IP, cidr.Mask), nil
+	return GenerateIPWithGranularity(cidr, 0)
+}
+
+// GenerateIPWithGranularity generates a random IP address based on the given CIDR.
+//
+//   - A random subnet of length granularity is picked inside the CIDR, then a random
+//     host inside that subnet. A granularity of 0, or one not longer than the CIDR,
+//     picks a host straight from the CIDR.
+//   - Every host bit is randomized, including the leftover bits of prefixes
+//     which are not aligned on a byte (e.g. /44 or /29).
+//   - Reserved addresses of the innermost subnet are never returned.
+func GenerateIPWithGranularity(cidr net.IPNet, granularity int) (net.IP, error) {
+	subnet, err := RandomSubnet(cidr, granularity)
+	if err != nil {
+		return nil, err
 	}
 
-	return generateIPv6(cidr.IP, cidr.Mask), nil
+	return RandomHost(subnet)
 }
 
-// generateIPv4 generates a random IPv4 address within the given network
-func generateIPv4(ip net.IP, mask net.IPMask) net.IP {
-	// Convert to 4-byte representation
-	ip = ip.To4()
-	if ip == nil {
-		return nil
+// RandomSubnet returns a random subnet of length granularity inside the CIDR.
+// The CIDR itself is returned if the granularity is not longer than the CIDR.
+func RandomSubnet(cidr net.IPNet, granularity int) (net.IPNet, error) {
+	ip, ones, bits, err := normalize(cidr)
+	if err != nil {
+		return net.IPNet{}, err
 	}
 
-	// Create a new IP with the same network portion
-	result := make(net.IP, len(ip))
-	copy(result, ip)
+	if granularity <= ones {
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, nil
+	}
+	if granularity > bits {
+		granularity = bits
+	}
 
-	// Calculate the number of host bits
-	ones, _ := mask.Size()
-	hostBits := 32 - ones
+	randomizeBits(ip, ones, granularity)
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(granularity, bits)}, nil
+}
 
-	// Generate random bits only for the host portion
-	for i := 0; i < hostBits/8; i++ {
-		byteIndex := len(result) - 1 - i
-		if byteIndex >= 0 {
-			result[byteIndex] = byte(RandomInt(256))
+// RandomHost returns a random non-reserved host address inside the subnet.
+func RandomHost(subnet net.IPNet) (net.IP, error) {
+	base, ones, bits, err := normalize(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	for range maxAttempts {
+		ip := make(net.IP, len(base))
+		copy(ip, base)
+		randomizeBits(ip, ones, bits)
+
+		if !IsReserved(ip, ones) {
+			return ip, nil
 		}
 	}
 
-	return result
+	return nil, ErrNoAddress
 }
 
-// generateIPv6 generates a random IPv6 address within the given network
-func generateIPv6(ip net.IP, mask net.IPMask) net.IP {
-	// Create a new IP with the same network portion
-	result := make(net.IP, len(ip))
-	copy(result, ip)
+// IsReserved reports whether the IP is a reserved address of its subnet
+// of length ones:
+//
+//   - IPv4: the network and broadcast addresses, unless the subnet is a /31 or /32.
+//   - IPv6: the Subnet-Router anycast address (RFC 4291) unless the subnet is a /127
+//     or /128, and the reserved anycast interface identifiers (RFC 2526) when
+//     the subnet is a /64 or larger.
+func IsReserved(ip net.IP, ones int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if ones >= 31 {
+			return false
+		}
+		return hostBitsEqual(ip4, ones, 0x00) || hostBitsEqual(ip4, ones, 0xff)
+	}
+
+	ip = ip.To16()
+	if ip == nil || ones >= 127 {
+		return false
+	}
+
+	if hostBitsEqual(ip, ones, 0x00) {
+		return true
+	}
+
+	// RFC 2526: the highest 128 interface identifiers of a /64, from
+	// fdff:ffff:ffff:ff80 to fdff:ffff:ffff:ffff.
+	if ones <= 64 {
+		iid := ip[8:]
+		if iid[0] != 0xfd {
+			return false
+		}
+		for _, b := range iid[1:7] {
+			if b != 0xff {
+				return false
+			}
+		}
+		return iid[7] >= 0x80
+	}
+
+	return false
+}
+
+// SubnetCount returns the number of subnets of length granularity inside the CIDR,
+// capped to 2^63. The CIDR counts as a single subnet if the granularity is not
+// longer than the CIDR.
+func SubnetCount(cidr net.IPNet, granularity int) uint64 {
+	ones, bits := cidr.Mask.Size()
+	if granularity > bits {
+		granularity = bits
+	}
+	if granularity <= ones {
+		return 1
+	}
+
+	return 1 << min(granularity-ones, 63)
+}
+
+// SubnetAt returns the subnet of length granularity at the given index inside
+// the CIDR. Only the lowest 63 bits of the subnet range are addressable.
+func SubnetAt(cidr net.IPNet, granularity int, index uint64) (net.IPNet, error) {
+	ip, ones, bits, err := normalize(cidr)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+
+	if granularity > bits {
+		granularity = bits
+	}
+	if granularity <= ones {
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, nil
+	}
+
+	index %= SubnetCount(cidr, granularity)
+	for bit := granularity - 1; bit >= ones && index > 0; bit-- {
+		if index&1 == 1 {
+			ip[bit/8] |= 0x80 >> (bit % 8)
+		}
+		index >>= 1
+	}
 
-	// Calculate the number of host bits
-	ones, _ := mask.Size()
-	hostBits := 128 - ones
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(granularity, bits)}, nil
+}
+
+// EmbedIPv4 returns the IPv4 address embedded into the IPv6 prefix (RFC 6052).
+// The prefix length must be 32, 40, 48, 56, 64 or 96, bits 64 to 71 are left to zero.
+func EmbedIPv4(prefix net.IPNet, ip net.IP) (net.IP, error) {
+	ones, bits := prefix.Mask.Size()
+	ip4 := ip.To4()
+	if bits != 128 || ip4 == nil || prefix.IP.To4() != nil {
+		return nil, ErrInvalidPrefix
+	}
+
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, ErrInvalidPrefix
+	}
+
+	result := make(net.IP, net.IPv6len)
+	copy(result, prefix.IP.To16()[:ones/8])
+
+	pos := ones / 8
+	for _, b := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		result[pos] = b
+		pos++
+	}
+
+	return result, nil
+}
+
+// ExtractIPv4 returns the IPv4 address embedded into the IPv6 address under the prefix (RFC 6052).
+func ExtractIPv4(prefix net.IPNet, ip net.IP) (net.IP, error) {
+	ones, _ := prefix.Mask.Size()
+	ip6 := ip.To16()
+	if ip6 == nil || ip.To4() != nil || !prefix.Contains(ip) {
+		return nil, ErrInvalidPrefix
+	}
+
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, ErrInvalidPrefix
+	}
+
+	result := make(net.IP, net.IPv4len)
+	pos := ones / 8
+	for i := range result {
+		if pos == 8 {
+			pos++
+		}
+		result[i] = ip6[pos]
+		pos++
+	}
+
+	return result, nil
+}
+
+// normalize returns a copy of the CIDR network address in its 4 or 16 bytes
+// form along with the mask size.
+func normalize(cidr net.IPNet) (net.IP, int, int, error) {
+	ones, bits := cidr.Mask.Size()
+	if bits == 0 {
+		return nil, 0, 0, ErrInvalidPrefix
+	}
+
+	var ip net.IP
+	if bits == 32 {
+		ip = cidr.IP.To4()
+	} else {
+		ip = cidr.IP.To16()
+	}
+	if ip == nil {
+		return nil, 0, 0, ErrInvalidPrefix
+	}
+
+	return ip.Mask(net.CIDRMask(ones, bits)), ones, bits, nil
+}
+
+// randomizeBits replaces the bits of ip in [from, to) with random bits.
+func randomizeBits(ip net.IP, from, to int) {
+	for i := from / 8; i*8 < to; i++ {
+		var mask byte = 0xff
+		if lo := from - i*8; lo > 0 {
+			mask &= 0xff >> lo
+		}
+		if hi := (i+1)*8 - to; hi > 0 {
+			mask &= 0xff << hi
+		}
+
+		ip[i] = ip[i]&^mask | byte(RandomInt(256))&mask
+	}
+}
+
+// hostBitsEqual reports whether every bit of ip after ones is equal to the
+// matching bit of fill.
+func hostBitsEqual(ip net.IP, ones int, fill byte) bool {
+	for i := ones / 8; i < len(ip); i++ {
+		var mask byte = 0xff
+		if lo := ones - i*8; lo > 0 {
+			mask &= 0xff >> lo
+		}
 
-	// Generate random bits only for the host portion
-	for i := 0; i < hostBits/8; i++ {
-		byteIndex := len(result) - 1 - i
-		if byteIndex >= 0 {
-			result[byteIndex] = byte(RandomInt(256))
+		if ip[i]&mask != fill&mask {
+			return false
 		}
 	}
 
-	return result
+	return true
 }
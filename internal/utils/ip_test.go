@@ -61,3 +61,172 @@ func TestGenerateIPv6(t *testing.T) {
 		t.Logf("Generated IP: %v", ip)
 	}
 }
+
+func TestGenerateIPUnalignedPrefix(t *testing.T) {
+	cidrs := []string{
+		"10.0.0.0/29",
+		"10.0.0.0/13",
+		"2001:db8::/44",
+		"2001:db8::/61",
+	}
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("net.ParseCIDR() returned error: %v", err)
+		}
+
+		// The leftover bits of the partial byte must vary between draws.
+		seen := make(map[byte]struct{})
+		for range 256 {
+			ip, err := GenerateIP(*ipnet)
+			if err != nil {
+				t.Fatalf("GenerateIP() returned error: %v", err)
+			}
+
+			if !ipnet.Contains(ip) {
+				t.Fatalf("Generated IP %v is not in network %v", ip, cidr)
+			}
+
+			ones, bits := ipnet.Mask.Size()
+			partial := ip.To16()[16-bits/8+ones/8]
+			seen[partial] = struct{}{}
+		}
+
+		if len(seen) < 2 {
+			t.Errorf("Leftover bits of %v are never randomized", cidr)
+		}
+	}
+}
+
+func TestGenerateIPWithGranularity(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("2001:db8:1234::/48")
+
+	subnets := make(map[string]struct{})
+	for range 64 {
+		ip, err := GenerateIPWithGranularity(*ipnet, 64)
+		if err != nil {
+			t.Fatalf("GenerateIPWithGranularity() returned error: %v", err)
+		}
+
+		if !ipnet.Contains(ip) {
+			t.Fatalf("Generated IP %v is not in network %v", ip, ipnet)
+		}
+
+		subnets[ip.Mask(net.CIDRMask(64, 128)).String()] = struct{}{}
+	}
+
+	if len(subnets) < 32 {
+		t.Errorf("Expected diverse /64 subnets, got %d", len(subnets))
+	}
+}
+
+func TestGenerateIPAvoidsReserved(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("192.168.1.0/30")
+
+	for range 256 {
+		ip, err := GenerateIP(*ipnet)
+		if err != nil {
+			t.Fatalf("GenerateIP() returned error: %v", err)
+		}
+
+		if ip.Equal(net.ParseIP("192.168.1.0")) || ip.Equal(net.ParseIP("192.168.1.3")) {
+			t.Fatalf("Generated reserved IP %v", ip)
+		}
+	}
+
+	_, ipnet, _ = net.ParseCIDR("2001:db8::/127")
+	for range 16 {
+		if _, err := GenerateIP(*ipnet); err != nil {
+			t.Fatalf("GenerateIP() returned error: %v", err)
+		}
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	tests := []struct {
+		ip       string
+		ones     int
+		reserved bool
+	}{
+		{"10.0.0.0", 24, true},
+		{"10.0.0.255", 24, true},
+		{"10.0.0.1", 24, false},
+		{"10.0.0.0", 31, false},
+		{"2001:db8::", 64, true},
+		{"2001:db8::1", 64, false},
+		{"2001:db8::fdff:ffff:ffff:ff80", 64, true},
+		{"2001:db8::fdff:ffff:ffff:ff7f", 64, false},
+		{"2001:db8::fdff:ffff:ffff:ffff", 96, false},
+		{"2001:db8::", 127, false},
+	}
+
+	for _, test := range tests {
+		if got := IsReserved(net.ParseIP(test.ip), test.ones); got != test.reserved {
+			t.Errorf("IsReserved(%s, %d) = %v, expected %v", test.ip, test.ones, got, test.reserved)
+		}
+	}
+}
+
+func TestSubnetAt(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("2001:db8::/44")
+
+	if count := SubnetCount(*ipnet, 48); count != 16 {
+		t.Fatalf("SubnetCount() = %d, expected 16", count)
+	}
+
+	tests := map[uint64]string{
+		0:  "2001:db8::/48",
+		1:  "2001:db8:1::/48",
+		15: "2001:db8:f::/48",
+		16: "2001:db8::/48",
+	}
+
+	for index, expected := range tests {
+		subnet, err := SubnetAt(*ipnet, 48, index)
+		if err != nil {
+			t.Fatalf("SubnetAt() returned error: %v", err)
+		}
+
+		if subnet.String() != expected {
+			t.Errorf("SubnetAt(%d) = %v, expected %v", index, subnet.String(), expected)
+		}
+	}
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// Examples of RFC 6052 section 2.4
+	tests := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::192.0.2.33",
+		"64:ff9b::/96":          "64:ff9b::192.0.2.33",
+	}
+
+	for cidr, expected := range tests {
+		_, prefix, _ := net.ParseCIDR(cidr)
+		ip, err := EmbedIPv4(*prefix, net.ParseIP("192.0.2.33"))
+		if err != nil {
+			t.Fatalf("EmbedIPv4(%s) returned error: %v", cidr, err)
+		}
+
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("EmbedIPv4(%s) = %s, expected %s", cidr, ip, expected)
+		}
+
+		ip4, err := ExtractIPv4(*prefix, ip)
+		if err != nil || !ip4.Equal(net.ParseIP("192.0.2.33")) {
+			t.Errorf("ExtractIPv4(%s, %s) = %s, %v, expected 192.0.2.33", cidr, ip, ip4, err)
+		}
+	}
+
+	for _, cidr := range []string{"64:ff9b::/80", "10.0.0.0/8"} {
+		_, prefix, _ := net.ParseCIDR(cidr)
+		if _, err := EmbedIPv4(*prefix, net.ParseIP("192.0.2.33")); err != ErrInvalidPrefix {
+			t.Errorf("EmbedIPv4(%s) returned %v, expected ErrInvalidPrefix", cidr, err)
+		}
+	}
+}
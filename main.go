@@ -5,44 +5,40 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/libp2p/go-reuseport"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/vlourme/go-proxy/internal/accounting"
+	"github.com/vlourme/go-proxy/internal/admin"
 	"github.com/vlourme/go-proxy/internal/config"
 	"github.com/vlourme/go-proxy/internal/handlers"
 	"github.com/vlourme/go-proxy/internal/sys"
 )
 
 func main() {
-	config := config.Get()
+	cfg := config.Get()
 
-	if config.DebugMode {
+	if cfg.DebugMode {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	}
 
 	sys.TuneSysctl()
-	for _, prefix := range config.BindPrefixes {
-		if err := sys.AddRoute(prefix); err != nil {
-			if err.Error() == "file exists" {
-				log.Info().Str("prefix", prefix).Msg("Route already exists")
-			} else {
-				log.Error().Err(err).Str("prefix", prefix).Msg("Failed to add route")
-			}
-		}
-	}
+	addRoutes()
 
 	addr := net.TCPAddr{
-		IP:   net.ParseIP(config.ListenAddress),
-		Port: int(config.ListenPort),
+		IP:   net.ParseIP(cfg.ListenAddress),
+		Port: int(cfg.ListenPort),
 	}
 
-	if config.TestPort > 0 {
-		log.Info().Uint16("port", config.TestPort).Msg("Starting test server")
+	if cfg.TestPort > 0 {
+		log.Info().Uint16("port", cfg.TestPort).Msg("Starting test server")
 		go func() {
 			server := &http.Server{
-				Addr: fmt.Sprintf("[::]:%d", config.TestPort),
+				Addr: fmt.Sprintf("[::]:%d", cfg.TestPort),
 				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					w.Write([]byte("Hello, World!"))
 				}),
@@ -53,6 +49,23 @@ func main() {
 		}()
 	}
 
+	if err := accounting.Start(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start accounting")
+	}
+
+	if cfg.AdminAddress != "" {
+		log.Info().Str("address", cfg.AdminAddress).Msg("Starting admin server")
+		go func() {
+			server := &http.Server{
+				Addr:    cfg.AdminAddress,
+				Handler: admin.Handler(),
+			}
+			if err := server.ListenAndServe(); err != nil {
+				log.Error().Err(err).Msg("Failed to start admin server")
+			}
+		}()
+	}
+
 	log.Info().Int("count", runtime.NumCPU()).Str("address", addr.String()).Msg("Starting listeners")
 	for idx := range runtime.NumCPU() {
 		go func(idx int) {
@@ -73,5 +86,37 @@ func main() {
 		}(idx)
 	}
 
-	select {}
+	// Reload the config on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for range reload {
+		if err := config.Reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload config")
+			continue
+		}
+
+		addRoutes()
+		log.Info().Msg("Config reloaded")
+	}
+}
+
+// addRoutes adds a local route for the prefixes of every pool
+// but the fallback and derived ones
+func addRoutes() {
+	for _, pool := range config.GetPools().Pools() {
+		if pool.Fallback || pool.Derived {
+			continue
+		}
+
+		for _, ipnet := range pool.Prefixes {
+			prefix := ipnet.String()
+			if err := sys.AddRoute(prefix); err != nil {
+				if err.Error() == "file exists" {
+					log.Info().Str("prefix", prefix).Msg("Route already exists")
+				} else {
+					log.Error().Err(err).Str("prefix", prefix).Msg("Failed to add route")
+				}
+			}
+		}
+	}
 }